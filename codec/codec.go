@@ -0,0 +1,243 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package codec splits the input of a connection into frames, such as lines
+// or length-prefixed messages, and encodes frames for the output.
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrTooLong is returned when a frame is longer than the maximum length.
+	ErrTooLong = errors.New("codec: frame too long")
+	// ErrLength is returned when a frame has the wrong length for the codec.
+	ErrLength = errors.New("codec: invalid frame length")
+	// ErrCodec is returned by a codec that is not configured correctly.
+	ErrCodec = errors.New("codec: invalid codec")
+)
+
+// Decoder splits input into frames.
+type Decoder interface {
+	// Decode returns the first frame in b and the number of bytes that it
+	// used. It returns zero bytes when b has no complete frame. The frame
+	// may share memory with b.
+	Decode(b []byte) (frame []byte, n int, err error)
+}
+
+// Encoder encodes frames.
+type Encoder interface {
+	// Encode appends the encoded frame to dst and returns the new slice.
+	Encode(dst, frame []byte) ([]byte, error)
+}
+
+// Codec is a Decoder and an Encoder.
+type Codec interface {
+	Decoder
+	Encoder
+}
+
+// Line splits lines that end with "\n" or "\r\n". The frames don't include
+// the line endings.
+type Line struct {
+	MaxLength int  // maximum length of a line, or 0 for no limit
+	CRLF      bool // Encode ends the lines with "\r\n" instead of "\n"
+}
+
+// Decode returns the first line in b.
+func (l Line) Decode(b []byte) (frame []byte, n int, err error) {
+	i := bytes.IndexByte(b, '\n')
+	if i == -1 {
+		if l.MaxLength > 0 && len(b) > l.MaxLength+1 {
+			return nil, 0, ErrTooLong
+		}
+		return nil, 0, nil
+	}
+	frame = b[:i]
+	if len(frame) > 0 && frame[len(frame)-1] == '\r' {
+		frame = frame[:len(frame)-1]
+	}
+	if l.MaxLength > 0 && len(frame) > l.MaxLength {
+		return nil, 0, ErrTooLong
+	}
+	return frame, i + 1, nil
+}
+
+// Encode appends the line and a line ending to dst.
+func (l Line) Encode(dst, frame []byte) ([]byte, error) {
+	if l.MaxLength > 0 && len(frame) > l.MaxLength {
+		return dst, ErrTooLong
+	}
+	dst = append(dst, frame...)
+	if l.CRLF {
+		return append(dst, '\r', '\n'), nil
+	}
+	return append(dst, '\n'), nil
+}
+
+// Delimiter splits frames that end with a delimiter. The frames don't
+// include the delimiter.
+type Delimiter struct {
+	Delim     []byte // delimiter, which must not be empty
+	MaxLength int    // maximum length of a frame, or 0 for no limit
+}
+
+// Decode returns the first frame in b.
+func (d Delimiter) Decode(b []byte) (frame []byte, n int, err error) {
+	if len(d.Delim) == 0 {
+		return nil, 0, ErrCodec
+	}
+	i := bytes.Index(b, d.Delim)
+	if i == -1 {
+		if d.MaxLength > 0 && len(b) > d.MaxLength+len(d.Delim)-1 {
+			return nil, 0, ErrTooLong
+		}
+		return nil, 0, nil
+	}
+	if d.MaxLength > 0 && i > d.MaxLength {
+		return nil, 0, ErrTooLong
+	}
+	return b[:i], i + len(d.Delim), nil
+}
+
+// Encode appends the frame and the delimiter to dst.
+func (d Delimiter) Encode(dst, frame []byte) ([]byte, error) {
+	if len(d.Delim) == 0 {
+		return dst, ErrCodec
+	}
+	if d.MaxLength > 0 && len(frame) > d.MaxLength {
+		return dst, ErrTooLong
+	}
+	return append(append(dst, frame...), d.Delim...), nil
+}
+
+// FixedLength splits frames that all have the same length.
+type FixedLength struct {
+	Size int // length of the frames, which must be greater than 0
+}
+
+// Decode returns the first frame in b.
+func (f FixedLength) Decode(b []byte) (frame []byte, n int, err error) {
+	if f.Size <= 0 {
+		return nil, 0, ErrCodec
+	}
+	if len(b) < f.Size {
+		return nil, 0, nil
+	}
+	return b[:f.Size], f.Size, nil
+}
+
+// Encode appends the frame to dst. The frame must have the length of the
+// codec.
+func (f FixedLength) Encode(dst, frame []byte) ([]byte, error) {
+	if len(frame) != f.Size {
+		return dst, ErrLength
+	}
+	return append(dst, frame...), nil
+}
+
+// LengthPrefixed splits frames that start with their length. The length
+// doesn't include itself.
+type LengthPrefixed struct {
+	// Size is the size of the length in bytes, which is 1, 2, 4, or 8, or 0
+	// for an unsigned varint.
+	Size int
+	// LittleEndian is the byte order of the length. The default is big
+	// endian.
+	LittleEndian bool
+	// MaxLength is the maximum length of a frame, or 0 for no limit.
+	MaxLength int
+}
+
+func (p LengthPrefixed) order() binary.ByteOrder {
+	if p.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Decode returns the first frame in b.
+func (p LengthPrefixed) Decode(b []byte) (frame []byte, n int, err error) {
+	var length uint64
+	switch p.Size {
+	case 0:
+		length, n = binary.Uvarint(b)
+		if n < 0 {
+			return nil, 0, ErrTooLong
+		}
+		if n == 0 {
+			if len(b) >= binary.MaxVarintLen64 {
+				return nil, 0, ErrTooLong
+			}
+			return nil, 0, nil
+		}
+	case 1, 2, 4, 8:
+		if len(b) < p.Size {
+			return nil, 0, nil
+		}
+		n = p.Size
+		switch p.Size {
+		case 1:
+			length = uint64(b[0])
+		case 2:
+			length = uint64(p.order().Uint16(b))
+		case 4:
+			length = uint64(p.order().Uint32(b))
+		case 8:
+			length = p.order().Uint64(b)
+		}
+	default:
+		return nil, 0, ErrCodec
+	}
+	if (p.MaxLength > 0 && length > uint64(p.MaxLength)) ||
+		length > uint64(maxInt-n) {
+		return nil, 0, ErrTooLong
+	}
+	if uint64(len(b)-n) < length {
+		return nil, 0, nil
+	}
+	end := n + int(length)
+	return b[n:end], end, nil
+}
+
+// Encode appends the length and the frame to dst.
+func (p LengthPrefixed) Encode(dst, frame []byte) ([]byte, error) {
+	if p.MaxLength > 0 && len(frame) > p.MaxLength {
+		return dst, ErrTooLong
+	}
+	length := uint64(len(frame))
+	var b [binary.MaxVarintLen64]byte
+	switch p.Size {
+	case 0:
+		dst = append(dst, b[:binary.PutUvarint(b[:], length)]...)
+	case 1:
+		if length > 0xFF {
+			return dst, ErrTooLong
+		}
+		dst = append(dst, byte(length))
+	case 2:
+		if length > 0xFFFF {
+			return dst, ErrTooLong
+		}
+		p.order().PutUint16(b[:], uint16(length))
+		dst = append(dst, b[:2]...)
+	case 4:
+		if length > 0xFFFFFFFF {
+			return dst, ErrTooLong
+		}
+		p.order().PutUint32(b[:], uint32(length))
+		dst = append(dst, b[:4]...)
+	case 8:
+		p.order().PutUint64(b[:], length)
+		dst = append(dst, b[:8]...)
+	default:
+		return dst, ErrCodec
+	}
+	return append(dst, frame...), nil
+}
+
+const maxInt = int(^uint(0) >> 1)
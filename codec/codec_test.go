@@ -0,0 +1,95 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// decodeAll decodes the frames in b and returns them with the rest of b.
+func decodeAll(d Decoder, b []byte) (frames []string, rest []byte, err error) {
+	for {
+		frame, n, err := d.Decode(b)
+		if err != nil || n == 0 {
+			return frames, b, err
+		}
+		frames = append(frames, string(frame))
+		b = b[n:]
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		codec  Codec
+		frames []string
+	}{
+		{Line{}, []string{"hello", "", "world"}},
+		{Line{CRLF: true}, []string{"hello", "world"}},
+		{Delimiter{Delim: []byte("||")}, []string{"a|b", "", "c"}},
+		{FixedLength{Size: 3}, []string{"abc", "def"}},
+		{LengthPrefixed{Size: 1}, []string{"hello", ""}},
+		{LengthPrefixed{Size: 2}, []string{"hello", "world"}},
+		{LengthPrefixed{Size: 4, LittleEndian: true}, []string{"hello"}},
+		{LengthPrefixed{Size: 8}, []string{"hello", "world"}},
+		{LengthPrefixed{}, []string{"hello", string(make([]byte, 300))}},
+	}
+	for i, test := range tests {
+		var b []byte
+		for _, frame := range test.frames {
+			var err error
+			b, err = test.codec.Encode(b, []byte(frame))
+			if err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+		}
+		// every split of the input decodes the same frames
+		for j := 0; j <= len(b); j++ {
+			frames, rest, err := decodeAll(test.codec, b[:j])
+			if err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+			more, rest, err := decodeAll(test.codec, append(rest, b[j:]...))
+			if err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+			frames = append(frames, more...)
+			if len(rest) != 0 ||
+				fmt.Sprint(frames) != fmt.Sprint(test.frames) {
+				t.Fatalf("test %d: expected %q, got %q", i, test.frames, frames)
+			}
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 100)
+	tests := []struct {
+		codec Codec
+		input []byte
+		err   error
+	}{
+		{Line{MaxLength: 10}, long, ErrTooLong},
+		{Line{MaxLength: 10}, append(long, '\n'), ErrTooLong},
+		{Delimiter{}, long, ErrCodec},
+		{Delimiter{Delim: []byte("|"), MaxLength: 10}, long, ErrTooLong},
+		{FixedLength{}, long, ErrCodec},
+		{LengthPrefixed{Size: 3}, long, ErrCodec},
+		{LengthPrefixed{Size: 1, MaxLength: 10}, []byte{11}, ErrTooLong},
+		{LengthPrefixed{}, bytes.Repeat([]byte{0xFF}, 11), ErrTooLong},
+	}
+	for i, test := range tests {
+		if _, _, err := test.codec.Decode(test.input); err != test.err {
+			t.Fatalf("test %d: expected '%v', got '%v'", i, test.err, err)
+		}
+	}
+	if _, err := (FixedLength{Size: 3}).Encode(nil, long); err != ErrLength {
+		t.Fatalf("expected '%v', got '%v'", ErrLength, err)
+	}
+	if _, err := (LengthPrefixed{Size: 1}).Encode(nil, make([]byte, 256)); err != ErrTooLong {
+		t.Fatalf("expected '%v', got '%v'", ErrTooLong, err)
+	}
+}
@@ -5,11 +5,21 @@
 package evio
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"os"
+	"os/user"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/tidwall/evio/codec"
 )
 
 // Action is an action that occurs after the completion of an event.
@@ -46,8 +56,149 @@ type Server struct {
 	Addrs []net.Addr
 	// NumLoops is the number of loops that the server is using.
 	NumLoops int
+
+	e engine // the running server
+}
+
+// Stats returns statistics about the connections of the running server, or
+// zero statistics for a Server that is not running. The other methods of a
+// Server that is not running return an error.
+func (s Server) Stats() Stats {
+	if s.e == nil {
+		return Stats{}
+	}
+	return s.e.stats()
+}
+
+// PauseAccept stops accepting new connections on the address at addrIndex.
+// Existing connections are not affected and new connections wait in the
+// listen backlog until accepting is resumed. For UDP addresses no packets
+// are read while paused. This is safe to call from any goroutine.
+func (s Server) PauseAccept(addrIndex int) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.pauseAccept(addrIndex, true)
+}
+
+// ResumeAccept resumes accepting new connections on the address at addrIndex
+// that was previously paused with PauseAccept.
+func (s Server) ResumeAccept(addrIndex int) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.pauseAccept(addrIndex, false)
+}
+
+// Listen starts accepting connections on a new address while the server is
+// running. The address has the same format as the addresses passed to Serve
+// and the returned index is the AddrIndex for its connections. The index is
+// not reused when the address is closed. Connections on the new address use
+// the same backend and the same connection events as the server.
+func (s Server) Listen(addr string) (addrIndex int, err error) {
+	if s.e == nil {
+		return -1, errNotRunning
+	}
+	return s.e.listen(addr, nil)
+}
+
+// ListenEvents is like Listen, but the connections on the new address use
+// the connection events of events, as for an address that is bound to a
+// ServeMux.
+func (s Server) ListenEvents(addr string, events Events) (addrIndex int, err error) {
+	if s.e == nil {
+		return -1, errNotRunning
+	}
+	return s.e.listen(addr, &events)
+}
+
+// CloseListener stops accepting connections on the address at addrIndex and
+// closes it. Existing connections are not affected.
+func (s Server) CloseListener(addrIndex int) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.closeListener(addrIndex)
+}
+
+// JoinGroup joins the multicast group on the UDP address at addrIndex. The
+// iface is the name of the network interface, or empty to let the system
+// choose one.
+func (s Server) JoinGroup(addrIndex int, group net.IP, iface string) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.joinGroup(addrIndex, group, iface, true)
+}
+
+// LeaveGroup leaves the multicast group on the UDP address at addrIndex.
+func (s Server) LeaveGroup(addrIndex int, group net.IP, iface string) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.joinGroup(addrIndex, group, iface, false)
+}
+
+// WriteTo queues a datagram to be written to addr from the UDP address at
+// addrIndex. It's safe to call from any goroutine, such as for pushing
+// notifications or for replying after processing a datagram off the loop.
+func (s Server) WriteTo(addrIndex int, b []byte, addr net.Addr) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.writeTo(addrIndex, b, addr)
+}
+
+// Attach adds a connected socket as a new connection of the TCP or unix
+// address at addrIndex, which provides the connection events. The socket is
+// a file descriptor, an *os.File such as one from ReceivedFiles, a net.Conn
+// such as from a dialer, or the conn of a Detached event. The server takes
+// ownership of the socket: an *os.File or net.Conn is closed by Attach, and
+// must not be used or closed by the caller after the call. The connection
+// starts with the ctx context and the Opened event fires as for an accepted
+// connection, but the connection limits and the Accepting event do not
+// apply. It's safe to call from any goroutine.
+func (s Server) Attach(conn interface{}, addrIndex int, ctx interface{}) error {
+	if s.e == nil {
+		return errNotRunning
+	}
+	return s.e.attach(conn, addrIndex, ctx)
 }
 
+// Stats are the connection statistics of a running server.
+type Stats struct {
+	// Conns is the number of open connections.
+	Conns int
+	// Rejected is the total number of connections that were rejected by
+	// the connection limits or by the Accepting event.
+	Rejected uint64
+}
+
+// engine is the server implementation behind a Server.
+type engine interface {
+	stats() Stats
+	pauseAccept(addrIndex int, paused bool) error
+	listen(addr string, events *Events) (addrIndex int, err error)
+	closeListener(addrIndex int) error
+	writeTo(addrIndex int, b []byte, addr net.Addr) error
+	joinGroup(addrIndex int, group net.IP, iface string, join bool) error
+	attach(conn interface{}, addrIndex int, ctx interface{}) error
+}
+
+var errAddrIndex = errors.New("invalid address index")
+var errNotRunning = errors.New("server not running")
+var errListenerClosed = errors.New("listener closed")
+var errNotUDP = errors.New("not a UDP address")
+var errNotSession = errors.New("not a UDP session")
+var errAbstract = errors.New("abstract unix sockets are only available on Linux")
+var errNotStream = errors.New("not a TCP or unix address")
+var errAttach = errors.New("unsupported connection type")
+var errNotUnix = errors.New("not a unix socket connection")
+var errEmptyPayload = errors.New("empty payload")
+var errModeOption = errors.New("invalid mode option")
+var errTTLOption = errors.New("invalid ttl option")
+var errTimeoutOption = errors.New("invalid timeout option")
+
 // Conn is an evio connection.
 type Conn interface {
 	// Context returns a user-defined context.
@@ -62,6 +213,49 @@ type Conn interface {
 	RemoteAddr() net.Addr
 	// Wake triggers a Data event for this connection.
 	Wake()
+	// MoveTo migrates the connection to the loop at the specified index.
+	// The connection keeps its context and any pending output. The move
+	// happens asynchronously and an invalid index is ignored.
+	// Not available for UDP connections or the stdlib backend, where it does
+	// nothing.
+	MoveTo(loopIdx int)
+	// Send queues a datagram to be written to the remote address of a UDP
+	// session. It's safe to call from any goroutine. Returns an error for
+	// connections that are not UDP sessions.
+	Send(b []byte) error
+	// PeerCredentials returns the credentials of the process on the other
+	// end of a unix socket connection, or nil for other connections and
+	// when the credentials are not available.
+	PeerCredentials() *Credentials
+	// ReceivedFiles returns the files that were passed along with the input
+	// of the current Data event over a unix socket. The caller owns the
+	// returned files and must close them. Files that are not taken are
+	// closed after the event.
+	ReceivedFiles() []*os.File
+	// SendFiles queues the payload to be written with the files passed
+	// along over a unix socket, after any pending output. The files are
+	// duplicated, so they can be closed after the call. The payload must
+	// not be empty. It's safe to call from any goroutine, and returns an
+	// error once the connection is closed or detached.
+	SendFiles(files []*os.File, payload []byte) error
+	// ProxyHeader returns the PROXY protocol header that was received on an
+	// address with the proxyprotocol option, or nil for other connections.
+	ProxyHeader() *ProxyHeader
+	// TLSState returns the state of the TLS connection, such as the version,
+	// cipher suite, server name, protocol, and client certificates, or nil
+	// for connections that are not TLS.
+	TLSState() *tls.ConnectionState
+	// Input returns the input buffer of a connection whose events have a
+	// MaxInputBuffer, or nil for other connections.
+	Input() *InputBuffer
+}
+
+// Credentials are the credentials of the process on the other end of a
+// unix socket connection.
+type Credentials struct {
+	PID int // process id, or -1 on macOS, FreeBSD, and DragonFly BSD
+	UID int // user id
+	GID int // group id
 }
 
 // LoadBalance sets the load balancing method.
@@ -93,9 +287,76 @@ type Events struct {
 	// best effort to attempt to distribute the incoming connections between
 	// multiple loops. This option is only works when NumLoops is set.
 	LoadBalance LoadBalance
+	// Rebalance enables moving idle connections from the busiest loop to
+	// the least busy loop when their connection counts differ by more than
+	// this value. A connection is considered idle when it has not received
+	// any data since the previous rebalance check. Setting to 0 disables
+	// rebalancing. This option only works when NumLoops is set and is
+	// not available for the stdlib backend.
+	Rebalance int
+	// MaxConns is the maximum number of open connections for the server.
+	// New connections over this limit are closed right after they are
+	// accepted. A limit for a single address may also be provided with the
+	// maxconns option, such as "tcp://:5000?maxconns=100".
+	// Setting to 0 means no limit.
+	MaxConns int
+	// MaxConnsPerIP is the maximum number of open connections from the same
+	// remote IP address. Setting to 0 means no limit.
+	MaxConnsPerIP int
+	// PauseAcceptConns automatically pauses accepting new connections on
+	// all addresses, except for UDP, while the number of open connections
+	// is at or above this value. Setting to 0 disables this option.
+	PauseAcceptConns int
+	// PauseAcceptLatency automatically pauses accepting new connections on
+	// all addresses, except for UDP, while any loop takes longer than this
+	// duration to respond to a periodic probe, such as when the loops are
+	// overloaded. Setting to 0 disables this option.
+	PauseAcceptLatency time.Duration
+	// UDPSessions keeps a Conn for each remote address of a UDP address,
+	// so the connection context persists between datagrams. The Opened
+	// event fires on the first datagram from a remote address, and the
+	// Closed event fires when the session closes or expires. Return Close
+	// from an event to close the session. All the sessions of an address
+	// are handled by the same loop.
+	UDPSessions bool
+	// UDPSessionTimeout closes the UDP sessions that have not received a
+	// datagram for this duration. Setting to 0 means sessions do not
+	// expire.
+	UDPSessionTimeout time.Duration
+	// UDPMaxSessions is the maximum number of UDP sessions for each address.
+	// Datagrams from new remote addresses are dropped while the limit is
+	// reached. Setting to 0 means no limit.
+	UDPMaxSessions int
+	// MaxInputBuffer keeps the input of each connection in an InputBuffer,
+	// which is returned by the Input method of the Conn, with this maximum
+	// number of unconsumed bytes. The Data event then receives all of the
+	// unconsumed input, and must Discard the bytes that it consumes. The
+	// poll backend reads the socket directly into the buffer. A connection
+	// that reaches the limit is closed with an InputLimitError. Setting to 0
+	// means that the Data event receives each read as it arrives.
+	MaxInputBuffer int
+	// TLSConfig is the TLS configuration of the addresses that have the
+	// tls option, such as "tcp://:443?tls=true", unless the address has its
+	// own cert and key options. The handshake is done before the Opened
+	// event, and the Data event receives plaintext.
+	TLSConfig *tls.Config
+	// TLSRoutes select the certificate and the connection events of the TLS
+	// connections by the requested server name and the negotiated protocol.
+	// The first route that matches and has a Certificate, or Events, is
+	// used. Connections that match no route use the TLSConfig and these
+	// events.
+	TLSRoutes []TLSRoute
+	// Codec splits the input of the connections into the frames of the
+	// Frame event, such as codec.Line{} or codec.LengthPrefixed{Size: 4}.
+	Codec codec.Decoder
 	// Serving fires when the server can accept connections. The server
 	// parameter has information and various utilities.
 	Serving func(server Server) (action Action)
+	// Accepting fires right after a connection is accepted and before any
+	// state is allocated for it. The remote parameter is the address of the
+	// peer. Return Close to reject the connection. Not available for UDP
+	// connections.
+	Accepting func(remote net.Addr, addrIndex int) (action Action)
 	// Opened fires when a new connection has opened.
 	// The info parameter has information about the connection such as
 	// it's local and remote address.
@@ -111,7 +372,9 @@ type Events struct {
 	// this connection.
 	// The conn parameter is a ReadWriteCloser that represents the
 	// underlying socket connection. It can be freely used in goroutines
-	// and should be closed when it's no longer needed.
+	// and should be closed when it's no longer needed. It's also a
+	// net.Conn with addresses and deadlines, and reads any input that was
+	// received by the loop and not yet handled before the socket.
 	Detached func(c Conn, rwc io.ReadWriteCloser) (action Action)
 	// PreWrite fires just before any data is written to any client socket.
 	PreWrite func()
@@ -119,6 +382,16 @@ type Events struct {
 	// The in parameter is the incoming data.
 	// Use the out return value to write data to the connection.
 	Data func(c Conn, in []byte) (out []byte, action Action)
+	// Frame fires once for each complete frame of the input, which is
+	// decoded with the Codec, and replaces the Data event. The frame is
+	// only valid during the event. Wake fires a Frame event with a nil
+	// frame. A connection whose input can't be decoded is closed.
+	Frame func(c Conn, frame []byte) (out []byte, action Action)
+	// AcceptError fires when accepting a new connection fails for a reason
+	// other than a problem with the pending connection itself, such as the
+	// process running out of file descriptors. The server keeps accepting
+	// connections following this event.
+	AcceptError func(addrIndex int, err error) (action Action)
 	// Tick fires immediately after the server starts and will fire again
 	// following the duration specified by the delay return value.
 	Tick func() (delay time.Duration, action Action)
@@ -129,16 +402,51 @@ type Events struct {
 // Addresses should use a scheme prefix and be formatted
 // like `tcp://192.168.0.10:9851` or `unix://socket`.
 // Valid network schemes:
-//  tcp   - bind to both IPv4 and IPv6
-//  tcp4  - IPv4
-//  tcp6  - IPv6
-//  udp   - bind to both IPv4 and IPv6
-//  udp4  - IPv4
-//  udp6  - IPv6
-//  unix  - Unix Domain Socket
+//  tcp        - bind to both IPv4 and IPv6
+//  tcp4       - IPv4
+//  tcp6       - IPv6
+//  udp        - bind to both IPv4 and IPv6
+//  udp4       - IPv4
+//  udp6       - IPv6
+//  unix       - Unix Domain Socket
+//  unixgram   - Unix Domain Socket for datagrams
+//  unixpacket - Unix Domain Socket for messages over connections
 //
-// The "tcp" network scheme is assumed when one is not specified.
+// The "tcp" network scheme is assumed when one is not specified. A scheme
+// with the "-net" suffix, such as `tcp-net://:9851`, uses the stdlib net
+// package instead of the platform's poller. On Linux, a unix address that
+// starts with "@", such as `unix://@app`, is in the abstract namespace.
 func Serve(events Events, addr ...string) error {
+	return serveAddrs(events, addr, nil)
+}
+
+// ServeMux serves addresses that each have their own connection events,
+// while sharing the same loops, ticker and shutdown.
+type ServeMux struct {
+	addrs  []string
+	events []*Events
+}
+
+// Bind binds the addr to the events. Only the connection events, which are
+// Accepting, Opened, Closed, Detached, PreWrite, Data, Frame, and
+// AcceptError, and the Codec, TLSConfig, and TLSRoutes are used for the
+// addr. The other fields are ignored.
+func (mux *ServeMux) Bind(addr string, events Events) {
+	mux.addrs = append(mux.addrs, addr)
+	mux.events = append(mux.events, &events)
+}
+
+// Serve starts handling events for the bound addresses. The server options
+// and events, such as NumLoops, Serving, and Tick, are taken from events.
+// Addresses that are added with Server.Listen use the connection events of
+// events, and Server.ListenEvents adds addresses with their own events.
+func (mux *ServeMux) Serve(events Events) error {
+	return serveAddrs(events, mux.addrs, mux.events)
+}
+
+// serveAddrs serves the addresses. When lnevents is not nil, it holds the
+// events of each address.
+func serveAddrs(events Events, addrs []string, lnevents []*Events) error {
 	var lns []*listener
 	defer func() {
 		for _, ln := range lns {
@@ -146,44 +454,28 @@ func Serve(events Events, addr ...string) error {
 		}
 	}()
 	var stdlib bool
-	for _, addr := range addr {
-		var ln listener
-		var stdlibt bool
-		ln.network, ln.addr, ln.opts, stdlibt = parseAddr(addr)
-		if stdlibt {
-			stdlib = true
+	for i, addr := range addrs {
+		ln, stdlibt, err := listen(addr)
+		if err != nil {
+			return err
 		}
-		if ln.network == "unix" {
-			os.RemoveAll(ln.addr)
+		if lnevents != nil {
+			ln.events = lnevents[i]
+			setFrameData(ln.events)
 		}
-		var err error
-		if ln.network == "udp" {
-			if ln.opts.reusePort {
-				ln.pconn, err = reuseportListenPacket(ln.network, ln.addr)
-			} else {
-				ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
-			}
-		} else {
-			if ln.opts.reusePort {
-				ln.ln, err = reuseportListen(ln.network, ln.addr)
-			} else {
-				ln.ln, err = net.Listen(ln.network, ln.addr)
-			}
-		}
-		if err != nil {
+		if err := checkTLS(ln, &events); err != nil {
+			ln.close()
 			return err
 		}
-		if ln.pconn != nil {
-			ln.lnaddr = ln.pconn.LocalAddr()
-		} else {
-			ln.lnaddr = ln.ln.Addr()
+		if stdlibt {
+			stdlib = true
 		}
 		if !stdlib {
 			if err := ln.system(); err != nil {
 				return err
 			}
 		}
-		lns = append(lns, &ln)
+		lns = append(lns, ln)
 	}
 	if stdlib {
 		return stdserve(events, lns)
@@ -191,8 +483,148 @@ func Serve(events Events, addr ...string) error {
 	return serve(events, lns)
 }
 
+// listen creates a listener for the addr. The stdlib return value is true
+// when the address requests the stdlib backend.
+func listen(addr string) (ln *listener, stdlib bool, err error) {
+	ln = &listener{}
+	ln.network, ln.addr, ln.opts, stdlib, err = parseAddr(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if strings.HasPrefix(ln.network, "unix") {
+		if isAbstract(ln.addr) {
+			if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+				return nil, false, errAbstract
+			}
+		} else {
+			removeStaleSocket(ln.network, ln.addr)
+		}
+	}
+	sockFile := strings.HasPrefix(ln.network, "unix") && !isAbstract(ln.addr)
+	opts := ln.opts
+	if sockFile && (opts.mode != 0 || opts.group != "") {
+		// the socket file is only open to its owner until it has the
+		// group and mode of the options
+		umask, restore := restrictUmask(0077)
+		err = bindListener(ln)
+		restore()
+		if opts.mode == 0 {
+			opts.mode = 0777 &^ os.FileMode(umask)
+		}
+	} else {
+		err = bindListener(ln)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if ln.pconn != nil {
+		ln.lnaddr = ln.pconn.LocalAddr()
+	} else {
+		ln.lnaddr = ln.ln.Addr()
+	}
+	if err := loadTLS(ln); err != nil {
+		ln.close()
+		return nil, false, err
+	}
+	if sockFile {
+		if err := chmodSocket(ln.addr, opts); err != nil {
+			ln.close()
+			return nil, false, err
+		}
+	}
+	return ln, stdlib, nil
+}
+
+// bindListener creates the socket of the listener.
+func bindListener(ln *listener) (err error) {
+	if strings.HasPrefix(ln.network, "udp") || ln.network == "unixgram" {
+		if ln.opts.multicast {
+			ln.pconn, err = listenMulticast(ln.network, ln.addr, ln.opts)
+		} else if ln.opts.reusePort {
+			ln.pconn, err = reuseportListenPacket(ln.network, ln.addr)
+		} else {
+			ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
+		}
+	} else {
+		if ln.opts.reusePort {
+			ln.ln, err = reuseportListen(ln.network, ln.addr)
+		} else {
+			ln.ln, err = net.Listen(ln.network, ln.addr)
+		}
+	}
+	return err
+}
+
+// isAbstract returns true for a unix address in the Linux abstract
+// namespace, which has no socket file.
+func isAbstract(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+// removeStaleSocket removes the socket file of a unix address that nobody is
+// listening on, such as after a crash. Other files and sockets that are in
+// use are left alone, and binding to them fails.
+func removeStaleSocket(network, addr string) {
+	fi, err := os.Lstat(addr)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	c, err := net.DialTimeout(network, addr, time.Second)
+	if err == nil {
+		c.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(addr)
+	}
+}
+
+// chmodSocket applies the group and mode options to a unix socket file. The
+// group is changed first, so the mode never applies to the group that the
+// file was created with.
+func chmodSocket(addr string, opts addrOpts) error {
+	if opts.group != "" {
+		gid, err := strconv.Atoi(opts.group)
+		if err != nil {
+			g, err := user.LookupGroup(opts.group)
+			if err != nil {
+				return err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return err
+			}
+		}
+		if err := os.Chown(addr, -1, gid); err != nil {
+			return err
+		}
+	}
+	if opts.mode != 0 {
+		if err := os.Chmod(addr, opts.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detachedConn is the net.Conn of a detached connection. Input that was
+// received by the loop after the connection was detached is read first.
+type detachedConn struct {
+	net.Conn
+	in []byte // extra input data
+}
+
+func (c *detachedConn) Read(p []byte) (n int, err error) {
+	if len(c.in) > 0 {
+		n = copy(p, c.in)
+		c.in = c.in[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
 // InputStream is a helper type for managing input streams from inside
-// the Data event.
+// the Data event. The MaxInputBuffer option keeps the input without copying
+// it.
 type InputStream struct{ b []byte }
 
 // Begin accepts a new packet and returns a working sequence of
@@ -218,21 +650,239 @@ func (is *InputStream) End(data []byte) {
 }
 
 type listener struct {
-	ln      net.Listener
-	lnaddr  net.Addr
-	pconn   net.PacketConn
-	opts    addrOpts
-	f       *os.File
-	fd      int
-	network string
-	addr    string
+	ln        net.Listener
+	lnaddr    net.Addr
+	pconn     net.PacketConn
+	opts      addrOpts
+	f         *os.File
+	fd        int
+	network   string
+	addr      string
+	conns     int64       // open connections
+	sessions  int64       // open UDP sessions
+	paused    int32       // accepting paused by PauseAccept
+	deadline  bool        // stdlib: a deadline interrupts the paused listener
+	pktinfo   bool        // poll: local addresses of datagrams are received
+	tlscfg    *tls.Config // TLS configuration of the cert and key options
+	tlsroute  *tls.Config // TLS configuration with the routes
+	tlsevents []*Events   // events of the TLS routes
+	tlsonce   sync.Once
+	events    *Events // events of the connections
+	closed    int32   // closed by CloseListener
+	refs      int32   // loops that have yet to release the closed listener
+	once      sync.Once
+}
+
+// listenerList is a list of listeners that is safe to read from any
+// goroutine. Listeners are never removed, so an index stays valid for the
+// lifetime of the server.
+type listenerList struct {
+	mu sync.Mutex   // guards adding listeners
+	v  atomic.Value // []*listener
+}
+
+func (lns *listenerList) load() []*listener {
+	v, _ := lns.v.Load().([]*listener)
+	return v
+}
+
+// get returns the listener at index i, or nil if there's no such listener.
+func (lns *listenerList) get(i int) *listener {
+	v := lns.load()
+	if i < 0 || i >= len(v) {
+		return nil
+	}
+	return v[i]
+}
+
+// add appends a listener and returns its index.
+func (lns *listenerList) add(ln *listener) int {
+	lns.mu.Lock()
+	v := lns.load()
+	nv := make([]*listener, len(v), len(v)+1)
+	copy(nv, v)
+	lns.v.Store(append(nv, ln))
+	lns.mu.Unlock()
+	return len(v)
 }
 
 type addrOpts struct {
-	reusePort bool
+	reusePort    bool
+	maxConns     int
+	batch        int           // UDP datagrams to read with a single syscall
+	gso          int           // UDP segment size for writing large data
+	gro          bool          // receive coalesced UDP datagrams
+	multicast    bool          // join the UDP multicast group of the address
+	iface        string        // multicast interface
+	ttl          int           // multicast time-to-live
+	loop         *bool         // loop sent multicast datagrams back to the host
+	mode         os.FileMode   // unix socket file permissions
+	group        string        // unix socket file group name or id
+	proxy        bool          // read a PROXY protocol header before opening
+	proxyTimeout time.Duration // time to wait for the PROXY protocol header
+	tlsTimeout   time.Duration // time to wait for the TLS handshake
+	tls          bool          // terminate TLS on the connections
+	cert         string        // TLS certificate file
+	key          string        // TLS private key file
+}
+
+// connLimits enforces the connection limits of a server.
+type connLimits struct {
+	maxConns int            // server-wide connection limit
+	maxPerIP int            // connection limit per remote ip
+	conns    int64          // open connections
+	rejected uint64         // rejected connections
+	mu       sync.Mutex     // guards ips
+	ips      map[string]int // open connections per remote ip
+}
+
+// admit counts a new connection from the remote address on the listener
+// and returns false if it goes over any of the limits. The returned ip is
+// the key which the connection was counted for and must be passed to
+// release.
+func (lim *connLimits) admit(ln *listener, remote net.Addr) (ip string, ok bool) {
+	n := atomic.AddInt64(&lim.conns, 1)
+	m := atomic.AddInt64(&ln.conns, 1)
+	if (lim.maxConns > 0 && n > int64(lim.maxConns)) ||
+		(ln.opts.maxConns > 0 && m > int64(ln.opts.maxConns)) {
+		lim.reject(ln, "")
+		return "", false
+	}
+	return lim.admitIP(ln, remote)
+}
+
+// readmit counts a connection that was admitted for the ip under another
+// remote address, such as the source of a PROXY protocol header, and
+// returns false if it goes over the limit per ip.
+func (lim *connLimits) readmit(ln *listener, ip string, remote net.Addr) (string, bool) {
+	lim.releaseIP(ip)
+	return lim.admitIP(ln, remote)
+}
+
+// admitIP counts a connection that is counted for the server and the
+// listener for the ip of the remote address.
+func (lim *connLimits) admitIP(ln *listener, remote net.Addr) (ip string, ok bool) {
+	if lim.maxPerIP > 0 {
+		if addr, ok := remote.(*net.TCPAddr); ok {
+			ip = string(addr.IP.To16())
+			lim.mu.Lock()
+			if lim.ips == nil {
+				lim.ips = make(map[string]int)
+			}
+			lim.ips[ip]++
+			n := lim.ips[ip]
+			lim.mu.Unlock()
+			if n > lim.maxPerIP {
+				lim.reject(ln, ip)
+				return "", false
+			}
+		}
+	}
+	return ip, true
+}
+
+// add counts a connection that is not subject to the limits, such as an
+// attached connection.
+func (lim *connLimits) add(ln *listener) {
+	atomic.AddInt64(&lim.conns, 1)
+	atomic.AddInt64(&ln.conns, 1)
+}
+
+// reject releases a connection that was counted by admit and counts it as
+// rejected.
+func (lim *connLimits) reject(ln *listener, ip string) {
+	lim.release(ln, ip)
+	atomic.AddUint64(&lim.rejected, 1)
+}
+
+// drop counts a connection as rejected, which is released separately, such
+// as one with a malformed PROXY protocol header.
+func (lim *connLimits) drop() {
+	atomic.AddUint64(&lim.rejected, 1)
+}
+
+// release stops counting a connection that was counted by admit.
+func (lim *connLimits) release(ln *listener, ip string) {
+	atomic.AddInt64(&lim.conns, -1)
+	atomic.AddInt64(&ln.conns, -1)
+	lim.releaseIP(ip)
+}
+
+func (lim *connLimits) releaseIP(ip string) {
+	if ip != "" {
+		lim.mu.Lock()
+		if lim.ips[ip]--; lim.ips[ip] <= 0 {
+			delete(lim.ips, ip)
+		}
+		lim.mu.Unlock()
+	}
+}
+
+func (lim *connLimits) stats() Stats {
+	return Stats{
+		Conns:    int(atomic.LoadInt64(&lim.conns)),
+		Rejected: atomic.LoadUint64(&lim.rejected),
+	}
+}
+
+// setFlag sets the flag at addr to v and returns true if it changed.
+func setFlag(addr *int32, v bool) bool {
+	if v {
+		return atomic.CompareAndSwapInt32(addr, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(addr, 1, 0)
+}
+
+// defaultProxyTimeout is the time that a connection can take to send its
+// PROXY protocol header when the proxytimeout option is not set.
+const defaultProxyTimeout = time.Second * 10
+
+// defaultTLSTimeout is the time that a connection can take to complete its
+// TLS handshake when the tlstimeout option is not set.
+const defaultTLSTimeout = time.Second * 10
+
+// pauseInterval is the delay between latency probes for the
+// PauseAcceptLatency option.
+var pauseInterval = time.Second / 10
+
+// latencyProbe measures how long a loop takes to respond.
+type latencyProbe struct{}
+
+// closeNote tells a loop that a listener was closed by CloseListener.
+type closeNote struct {
+	ln *listener
+}
+
+// udpExpireNote asks a loop to close its expired UDP sessions.
+type udpExpireNote struct{}
+
+// udpExpireInterval returns how often the UDP sessions are checked for
+// expiry.
+func udpExpireInterval(timeout time.Duration) time.Duration {
+	d := timeout / 4
+	if d > time.Second {
+		d = time.Second
+	} else if d < time.Millisecond*10 {
+		d = time.Millisecond * 10
+	}
+	return d
 }
 
-func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool) {
+// parseBool parses the value of an address option such as "true" or "1".
+func parseBool(v string) bool {
+	if len(v) != 0 {
+		switch v[0] {
+		default:
+			return v[0] >= '1' && v[0] <= '9'
+		case 'T', 't', 'Y', 'y':
+			return true
+		}
+	}
+	return false
+}
+
+func parseAddr(addr string) (network, address string, opts addrOpts,
+	stdlib bool, err error) {
 	network = "tcp"
 	address = addr
 	opts.reusePort = false
@@ -251,18 +901,67 @@ func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool
 			if len(kv) == 2 {
 				switch kv[0] {
 				case "reuseport":
-					if len(kv[1]) != 0 {
-						switch kv[1][0] {
-						default:
-							opts.reusePort = kv[1][0] >= '1' && kv[1][0] <= '9'
-						case 'T', 't', 'Y', 'y':
-							opts.reusePort = true
-						}
+					opts.reusePort = parseBool(kv[1])
+				case "maxconns":
+					opts.maxConns, _ = strconv.Atoi(kv[1])
+				case "batch":
+					opts.batch, _ = strconv.Atoi(kv[1])
+				case "gso":
+					opts.gso, _ = strconv.Atoi(kv[1])
+				case "gro":
+					opts.gro = parseBool(kv[1])
+				case "multicast":
+					opts.multicast = parseBool(kv[1])
+				case "iface":
+					opts.iface = kv[1]
+				case "ttl":
+					opts.ttl, err = strconv.Atoi(kv[1])
+					if err != nil || opts.ttl < 0 || opts.ttl > 255 {
+						return "", "", opts, false, errTTLOption
+					}
+				case "loop":
+					loop := parseBool(kv[1])
+					opts.loop = &loop
+				case "mode":
+					mode, err := strconv.ParseUint(kv[1], 8, 32)
+					if err != nil || mode > 0777 {
+						return "", "", opts, false, errModeOption
 					}
+					opts.mode = os.FileMode(mode)
+				case "group":
+					opts.group = kv[1]
+				case "proxyprotocol":
+					opts.proxy = parseBool(kv[1])
+				case "proxytimeout":
+					opts.proxyTimeout, err = time.ParseDuration(kv[1])
+					if err != nil {
+						return "", "", opts, false, errTimeoutOption
+					}
+				case "tls":
+					opts.tls = parseBool(kv[1])
+				case "tlstimeout":
+					opts.tlsTimeout, err = time.ParseDuration(kv[1])
+					if err != nil {
+						return "", "", opts, false, errTimeoutOption
+					}
+				case "cert":
+					opts.cert = kv[1]
+				case "key":
+					opts.key = kv[1]
 				}
 			}
 		}
 		address = address[:q]
 	}
+	if (opts.gso > 0 || opts.gro) && !strings.HasPrefix(network, "udp") {
+		// segmentation offload is a UDP option
+		return "", "", opts, false, errNotUDP
+	}
+	if opts.proxyTimeout <= 0 {
+		opts.proxyTimeout = defaultProxyTimeout
+	}
+	if opts.tlsTimeout <= 0 {
+		opts.tlsTimeout = defaultTLSTimeout
+	}
 	return
 }
@@ -0,0 +1,914 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/tidwall/evio/internal"
+)
+
+func TestAcceptEMFILE(t *testing.T) {
+	var rlim syscall.Rlimit
+	must(syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim))
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+
+	var acceptErr atomic.Value
+	var events Events
+	events.AcceptError = func(addrIndex int, err error) (action Action) {
+		acceptErr.Store(err)
+		return
+	}
+	var done int32
+	events.Tick = func() (delay time.Duration, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// leave room for the client socket but not for the server to
+			// accept the connection.
+			f, err := os.Open(os.DevNull)
+			must(err)
+			lim := rlim
+			lim.Cur = uint64(f.Fd()) + 1
+			f.Close()
+			must(syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim))
+			c, err := net.Dial("tcp", ":9982")
+			must(err)
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := c.Read([]byte{0}); err == nil {
+				panic("expected error")
+			} else if err, ok := err.(net.Error); ok && err.Timeout() {
+				panic("expected the connection to be closed")
+			}
+			atomic.StoreInt32(&done, 1)
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9982"))
+	if err, _ := acceptErr.Load().(error); err != syscall.EMFILE {
+		t.Fatalf("expected '%v', got '%v'", syscall.EMFILE, err)
+	}
+}
+
+func TestUDPSegments(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPSegments("udp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPSegments("udp-net", ":9984")
+	})
+}
+
+func testUDPSegments(network, addr string) {
+	var datas int
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "shutdown":
+			return nil, Shutdown
+		case "done":
+			out = make([]byte, 2500)
+			copy(out, fmt.Sprintf("%d ", datas))
+			return out, None
+		}
+		if len(in) != 1000 {
+			panic(fmt.Sprintf("expected 1000 bytes, got %d", len(in)))
+		}
+		datas++
+		return nil, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			raddr, err := net.ResolveUDPAddr("udp", addr)
+			must(err)
+			c, err := net.DialUDP("udp", nil, raddr)
+			must(err)
+			defer c.Close()
+			// write three datagrams with a single UDP_SEGMENT syscall
+			oob := make([]byte, syscall.CmsgSpace(2))
+			h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+			h.Level = syscall.IPPROTO_UDP
+			h.Type = 103 // UDP_SEGMENT
+			h.SetLen(syscall.CmsgLen(2))
+			*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = 1000
+			_, _, err = c.WriteMsgUDP(make([]byte, 3000), oob, nil)
+			must(err)
+			time.Sleep(time.Second / 10)
+			_, err = c.Write([]byte("done"))
+			must(err)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 0xFFFF)
+			var sizes []int
+			for i := 0; i < 3; i++ {
+				n, err := c.Read(buf)
+				must(err)
+				if i == 0 && !strings.HasPrefix(string(buf[:n]), "3 ") {
+					panic(fmt.Sprintf("expected 3 datagrams, got '%s'",
+						strings.TrimRight(string(buf[:8]), "\x00")))
+				}
+				sizes = append(sizes, n)
+			}
+			if fmt.Sprint(sizes) != "[1000 1000 500]" {
+				panic(fmt.Sprintf("expected [1000 1000 500], got %v", sizes))
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?gro=true&gso=1000"))
+}
+
+func TestUDPSegmentsOrder(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPSegmentsOrder("udp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPSegmentsOrder("udp-net", ":9984")
+	})
+}
+
+func testUDPSegmentsOrder(network, addr string) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "shutdown":
+			return nil, Shutdown
+		case "big":
+			// written as segments between the queued replies
+			return make([]byte, 2500), None
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			raddr, err := net.ResolveUDPAddr("udp", addr)
+			must(err)
+			c, err := net.DialUDP("udp", nil, raddr)
+			must(err)
+			defer c.Close()
+			// the datagrams are written before the server reads any of them
+			for _, msg := range []string{"a", "big", "b"} {
+				_, err = c.Write([]byte(msg))
+				must(err)
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 0xFFFF)
+			var replies []string
+			for i := 0; i < 5; i++ {
+				n, err := c.Read(buf)
+				must(err)
+				if buf[0] == 0 {
+					replies = append(replies, fmt.Sprint(n))
+				} else {
+					replies = append(replies, string(buf[:n]))
+				}
+			}
+			if fmt.Sprint(replies) != "[a 1000 1000 500 b]" {
+				panic(fmt.Sprintf("expected [a 1000 1000 500 b], got %v", replies))
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?batch=16&gso=1000"))
+}
+
+func TestSendMsgsError(t *testing.T) {
+	rc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	must(err)
+	defer rc.Close()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	must(err)
+	defer syscall.Close(fd)
+	to := &syscall.SockaddrInet4{Port: rc.LocalAddr().(*net.UDPAddr).Port,
+		Addr: [4]byte{127, 0, 0, 1}}
+	// the datagram to an IPv6 address fails on an IPv4 socket
+	msgs := []internal.Message{
+		{Buf: []byte("a"), Addr: to},
+		{Buf: []byte("x"), Addr: &syscall.SockaddrInet6{Port: 1}},
+		{Buf: []byte("b"), Addr: to},
+	}
+	var b internal.Batch
+	if n, err := b.SendMsgs(fd, msgs); n != 2 || err == nil {
+		t.Fatalf("expected 2 datagrams and an error, got %d, %v", n, err)
+	}
+	buf := make([]byte, 64)
+	for _, expect := range []string{"a", "b"} {
+		rc.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := rc.Read(buf)
+		must(err)
+		if string(buf[:n]) != expect {
+			t.Fatalf("expected '%s', got '%s'", expect, buf[:n])
+		}
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMulticast("udp", "9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMulticast("udp-net", "9984")
+	})
+}
+
+func testMulticast(network, port string) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			must(err)
+			defer c.Close()
+			// send the multicast datagrams over the loopback interface
+			rc, err := c.SyscallConn()
+			must(err)
+			rc.Control(func(fd uintptr) {
+				must(syscall.SetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP,
+					syscall.IP_MULTICAST_IF, [4]byte{127, 0, 0, 1}))
+			})
+			// echo returns true if the datagram to the group is echoed.
+			echo := func(group string) bool {
+				addr, err := net.ResolveUDPAddr("udp4", group+":"+port)
+				must(err)
+				_, err = c.WriteTo([]byte(group), addr)
+				must(err)
+				c.SetReadDeadline(time.Now().Add(time.Second / 5))
+				buf := make([]byte, 64)
+				n, _, err := c.ReadFrom(buf)
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					return false
+				}
+				must(err)
+				return string(buf[:n]) == group
+			}
+			if !echo("239.1.2.3") {
+				panic("expected echo")
+			}
+			if echo("239.1.2.4") {
+				panic("expected no echo")
+			}
+			must(srv.JoinGroup(0, net.ParseIP("239.1.2.4"), "lo"))
+			if !echo("239.1.2.4") {
+				panic("expected echo")
+			}
+			must(srv.LeaveGroup(0, net.ParseIP("239.1.2.4"), "lo"))
+			if echo("239.1.2.4") {
+				panic("expected no echo")
+			}
+			addr, err := net.ResolveUDPAddr("udp4", "239.1.2.3:"+port)
+			must(err)
+			c.WriteTo([]byte("shutdown"), addr)
+		}()
+		return
+	}
+	must(Serve(events, network+"://239.1.2.3:"+port+
+		"?multicast=true&iface=lo&loop=true&ttl=1"))
+}
+
+func TestMulticastLoop(t *testing.T) {
+	// the system default is kept unless the option is given
+	for query, expect := range map[string]int{
+		"": 1, "&loop=true": 1, "&loop=false": 0,
+	} {
+		_, addr, opts, _, err := parseAddr("udp://239.1.2.3:9983?multicast=true" +
+			query)
+		must(err)
+		pconn, err := listenMulticast("udp", addr, opts)
+		must(err)
+		var loop int
+		must(sockControl(pconn, func(fd int) (err error) {
+			loop, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_IP,
+				syscall.IP_MULTICAST_LOOP)
+			return err
+		}))
+		pconn.Close()
+		if loop != expect {
+			panic(fmt.Sprintf("%q: expected loop %d, got %d", query, expect, loop))
+		}
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testLocalAddr("tcp", "udp", "9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testLocalAddr("tcp-net", "", "9984")
+	})
+}
+
+func testLocalAddr(network, udpnetwork, port string) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		switch c.LocalAddr().(type) {
+		case *net.TCPAddr:
+			if _, ok := c.RemoteAddr().(*net.TCPAddr); !ok {
+				panic("expected a tcp remote address")
+			}
+		case *net.UDPAddr:
+			if _, ok := c.RemoteAddr().(*net.UDPAddr); !ok {
+				panic("expected a udp remote address")
+			}
+		}
+		return []byte(c.LocalAddr().String()), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			// 127.0.0.2 is not the default source address for replies to
+			// 127.0.0.1
+			networks := []string{"tcp"}
+			if udpnetwork != "" {
+				networks = append(networks, "udp")
+			}
+			for _, network := range networks {
+				c, err := net.Dial(network, "127.0.0.2:"+port)
+				must(err)
+				_, err = c.Write([]byte("hello"))
+				must(err)
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != "127.0.0.2:"+port {
+					panic(fmt.Sprintf("%s: expected '127.0.0.2:%s', got '%s'",
+						network, port, buf[:n]))
+				}
+				c.Close()
+			}
+			c, err := net.Dial("tcp", "127.0.0.1:"+port)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	addrs := []string{network + "://:" + port}
+	if udpnetwork != "" {
+		addrs = append(addrs, udpnetwork+"://:"+port)
+	}
+	must(Serve(events, addrs...))
+}
+
+func TestUDPBroadcastReply(t *testing.T) {
+	local, bcast := broadcastAddr()
+	if local == nil {
+		t.Skip("no interface with a broadcast address")
+	}
+	t.Run("poll", func(t *testing.T) {
+		testUDPBroadcastReply("udp", "9983", local, bcast)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPBroadcastReply("udp-net", "9984", local, bcast)
+	})
+}
+
+// broadcastAddr returns the address and the subnet broadcast address of an
+// IPv4 interface, or nil.
+func broadcastAddr() (local, bcast net.IP) {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip, mask := ipnet.IP.To4(), ipnet.Mask
+			bcast := make(net.IP, 4)
+			for i := range bcast {
+				bcast[i] = ip[i] | ^mask[len(mask)-4+i]
+			}
+			return ip, bcast
+		}
+	}
+	return nil, nil
+}
+
+func testUDPBroadcastReply(network, port string, local, bcast net.IP) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local})
+			must(err)
+			defer c.Close()
+			rc, err := c.SyscallConn()
+			must(err)
+			rc.Control(func(fd uintptr) {
+				must(syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+					syscall.SO_BROADCAST, 1))
+			})
+			for _, ip := range []net.IP{bcast, net.IPv4bcast} {
+				addr := &net.UDPAddr{IP: ip, Port: atoi(port)}
+				_, err = c.WriteTo([]byte(ip.String()), addr)
+				must(err)
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, from, err := c.ReadFrom(buf)
+				must(err)
+				if string(buf[:n]) != ip.String() {
+					panic(fmt.Sprintf("expected '%s', got '%s'", ip, buf[:n]))
+				}
+				if ip := from.(*net.UDPAddr).IP; !ip.Equal(local) {
+					panic(fmt.Sprintf("expected a reply from %s, got %s",
+						local, ip))
+				}
+			}
+			_, err = c.WriteTo([]byte("shutdown"),
+				&net.UDPAddr{IP: local, Port: atoi(port)})
+			must(err)
+		}()
+		return
+	}
+	must(Serve(events, network+"://:"+port))
+}
+
+func atoi(s string) int {
+	n, err := strconv.Atoi(s)
+	must(err)
+	return n
+}
+
+func TestUnixgram(t *testing.T) {
+	client := "evio-unixgram-client.sock"
+	t.Run("poll", func(t *testing.T) {
+		testUnixgram("unixgram", "", client, false)
+	})
+	t.Run("poll-sessions", func(t *testing.T) {
+		testUnixgram("unixgram", "", client, true)
+	})
+	t.Run("poll-batch", func(t *testing.T) {
+		testUnixgram("unixgram", "?batch=8", client, false)
+	})
+	t.Run("poll-batch-sessions", func(t *testing.T) {
+		testUnixgram("unixgram", "?batch=8", client, true)
+	})
+	t.Run("poll-batch-abstract", func(t *testing.T) {
+		testUnixgram("unixgram", "?batch=8", "@evio-unixgram-client", false)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUnixgram("unixgram-net", "", client, false)
+	})
+}
+
+func testUnixgram(network, query, client string, sessions bool) {
+	sock := "evio-unixgram.sock"
+	os.RemoveAll(client)
+	defer os.RemoveAll(client)
+	var events Events
+	events.UDPSessions = sessions
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		addr, ok := c.RemoteAddr().(*net.UnixAddr)
+		if !ok || addr.Name != client {
+			panic(fmt.Sprintf("expected '%s', got '%v'", client, c.RemoteAddr()))
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.ListenUnixgram("unixgram",
+				&net.UnixAddr{Name: client, Net: "unixgram"})
+			must(err)
+			defer c.Close()
+			raddr := &net.UnixAddr{Name: sock, Net: "unixgram"}
+			buf := make([]byte, 64)
+			for _, msg := range []string{"a", "bb", "ccc"} {
+				_, err = c.WriteTo([]byte(msg), raddr)
+				must(err)
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != msg {
+					panic(fmt.Sprintf("expected '%s', got '%s'", msg, buf[:n]))
+				}
+			}
+			c.WriteTo([]byte("shutdown"), raddr)
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+sock+query))
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		panic("expected the socket file to be removed")
+	}
+}
+
+func TestUnixpacket(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUnixpacket("unixpacket")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUnixpacket("unixpacket-net")
+	})
+}
+
+func testUnixpacket(network string) {
+	sock := "evio-unixpacket.sock"
+	var events Events
+	var sc atomic.Value
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		sc.Store(c)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "shutdown":
+			return nil, Shutdown
+		case "":
+			return []byte("woke"), None
+		case "wake":
+			// the output of the wake is a message of its own
+			go c.Wake()
+		case "big":
+			return []byte(strings.Repeat("x", 8192)), None
+		}
+		return []byte(fmt.Sprintf("%d", len(in))), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("unixpacket", sock)
+			must(err)
+			defer c.Close()
+			// the messages are written before the server reads any of them
+			for _, msg := range []string{"a", "bb", "ccc", "wake"} {
+				_, err = c.Write([]byte(msg))
+				must(err)
+			}
+			buf := make([]byte, 64)
+			for _, expect := range []string{"1", "2", "3", "4", "woke"} {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			// a wake while the socket buffer is full queues its output
+			// behind the output that is not yet written
+			for i := 0; i < 64; i++ {
+				_, err = c.Write([]byte("big"))
+				must(err)
+			}
+			time.Sleep(time.Second / 10)
+			go sc.Load().(Conn).Wake()
+			big := make([]byte, 0x10000)
+			var woke int
+			for i := 0; i < 65; i++ {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(big)
+				must(err)
+				if string(big[:n]) == "woke" {
+					woke++
+				} else if n != 8192 {
+					panic(fmt.Sprintf("expected 8192 bytes, got %d", n))
+				}
+			}
+			if woke != 1 {
+				panic(fmt.Sprintf("expected 1 wake, got %d", woke))
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+sock))
+}
+
+func TestUnixpacketInputLimit(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUnixpacketInputLimit("unixpacket")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUnixpacketInputLimit("unixpacket-net")
+	})
+}
+
+func testUnixpacketInputLimit(network string) {
+	sock := "evio-unixpacket.sock"
+	var events Events
+	events.MaxInputBuffer = 16
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// the input is left in the buffer
+		return []byte(fmt.Sprintf("%d", len(in))), None
+	}
+	var cerr error
+	events.Closed = func(c Conn, err error) (action Action) {
+		cerr = err
+		return Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("unixpacket", sock)
+			must(err)
+			defer c.Close()
+			buf := make([]byte, 64)
+			_, err = c.Write([]byte("0123456789"))
+			must(err)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := c.Read(buf)
+			must(err)
+			if string(buf[:n]) != "10" {
+				panic(fmt.Sprintf("expected '10', got '%s'", buf[:n]))
+			}
+			// the message doesn't fit and is not truncated
+			_, err = c.Write([]byte("abcdefghij"))
+			must(err)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err := c.Read(buf); err == nil {
+				panic(fmt.Sprintf("expected close, got '%s'", buf[:n]))
+			}
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+sock))
+	if _, ok := cerr.(*InputLimitError); !ok {
+		panic(fmt.Sprintf("expected input limit error, got %v", cerr))
+	}
+}
+
+func TestUnixOptions(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUnixOptions("unix")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUnixOptions("unix-net")
+	})
+}
+
+func testUnixOptions(network string) {
+	sock := "evio-options.sock"
+	os.RemoveAll(sock)
+	defer os.RemoveAll(sock)
+
+	// a regular file is not removed
+	must(ioutil.WriteFile(sock, []byte("data"), 0600))
+	if err := Serve(Events{}, network+"://"+sock); err == nil {
+		panic("expected error")
+	}
+	if b, err := ioutil.ReadFile(sock); err != nil || string(b) != "data" {
+		panic("expected the file to be left alone")
+	}
+	os.Remove(sock)
+
+	// a socket that is in use is not removed
+	ln, err := net.Listen("unix", sock)
+	must(err)
+	if err := Serve(Events{}, network+"://"+sock); err == nil {
+		panic("expected error")
+	}
+	c, err := net.Dial("unix", sock)
+	must(err)
+	c.Close()
+
+	// a stale socket is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	gid := os.Getgid()
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			fi, err := os.Stat(sock)
+			must(err)
+			if fi.Mode().Perm() != 0600 {
+				panic(fmt.Sprintf("expected mode 0600, got %v", fi.Mode().Perm()))
+			}
+			if st := fi.Sys().(*syscall.Stat_t); int(st.Gid) != gid {
+				panic(fmt.Sprintf("expected group %d, got %d", gid, st.Gid))
+			}
+			// the abstract address has no socket file
+			if _, err := os.Stat("@evio-options"); !os.IsNotExist(err) {
+				panic("expected no file")
+			}
+			c, err := net.Dial("unix", "@evio-options")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, fmt.Sprintf("%s://%s?mode=0600&group=%d", network, sock, gid),
+		network+"://@evio-options"))
+}
+
+func TestSocketMode(t *testing.T) {
+	sock := "evio-mode.sock"
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	for _, mode := range []os.FileMode{0666, 0600} {
+		ln, _, err := listen(fmt.Sprintf("unix://%s?mode=%o", sock, mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(sock)
+		ln.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Fatalf("expected mode %v, got %v", mode, fi.Mode().Perm())
+		}
+		if mask := syscall.Umask(022); mask != 022 {
+			t.Fatalf("expected umask 022, got %o", mask)
+		}
+	}
+}
+
+func TestPeerCredentials(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPeerCredentials("unix", "tcp", "9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testPeerCredentials("unix-net", "tcp-net", "9984")
+	})
+}
+
+func testPeerCredentials(unixnetwork, tcpnetwork, port string) {
+	sock := "evio-cred.sock"
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		cred := c.PeerCredentials()
+		if cred == nil {
+			return []byte("none"), None
+		}
+		return []byte(fmt.Sprintf("%d %d %d", cred.PID, cred.UID, cred.GID)), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			ask := func(network, addr string) string {
+				c, err := net.Dial(network, addr)
+				must(err)
+				defer c.Close()
+				_, err = c.Write([]byte("hello"))
+				must(err)
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				return string(buf[:n])
+			}
+			expect := fmt.Sprintf("%d %d %d", os.Getpid(), os.Getuid(), os.Getgid())
+			if res := ask("unix", sock); res != expect {
+				panic(fmt.Sprintf("expected '%s', got '%s'", expect, res))
+			}
+			if res := ask("tcp", ":"+port); res != "none" {
+				panic(fmt.Sprintf("expected 'none', got '%s'", res))
+			}
+			c, err := net.Dial("unix", sock)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, unixnetwork+"://"+sock, tcpnetwork+"://:"+port))
+}
+
+func TestPassFiles(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPassFiles("unix")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testPassFiles("unix-net")
+	})
+}
+
+func testPassFiles(network string) {
+	sock := "evio-files.sock"
+	var srv Server
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "shutdown":
+			return nil, Shutdown
+		case "attach":
+			files := c.ReceivedFiles()
+			if len(files) != 1 {
+				panic(fmt.Sprintf("expected 1 file, got %d", len(files)))
+			}
+			must(srv.Attach(files[0], 0, nil))
+			return []byte("attached"), None
+		case "pipe":
+			r, w, err := os.Pipe()
+			must(err)
+			_, err = w.Write([]byte("piped"))
+			must(err)
+			w.Close()
+			must(c.SendFiles([]*os.File{r}, []byte("file")))
+			r.Close()
+			return nil, None
+		}
+		return in, None
+	}
+	var closedErrs []error
+	events.Closed = func(c Conn, err error) (action Action) {
+		// files can't be sent on a closed connection
+		closedErrs = append(closedErrs,
+			c.SendFiles([]*os.File{os.Stdin}, []byte("x")))
+		return None
+	}
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: sock, Net: "unix"})
+			must(err)
+			defer c.Close()
+			buf := make([]byte, 64)
+			read := func(c net.Conn, expect string) {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			// pass one end of a socket pair to be attached by the server
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+			must(err)
+			a, b := os.NewFile(uintptr(fds[0]), ""), os.NewFile(uintptr(fds[1]), "")
+			_, _, err = c.WriteMsgUnix([]byte("attach"), syscall.UnixRights(fds[1]), nil)
+			must(err)
+			b.Close()
+			read(c, "attached")
+			ac, err := net.FileConn(a)
+			must(err)
+			a.Close()
+			defer ac.Close()
+			_, err = ac.Write([]byte("hello"))
+			must(err)
+			read(ac, "hello")
+
+			// receive a pipe from the server
+			_, err = c.Write([]byte("pipe"))
+			must(err)
+			oob := make([]byte, syscall.CmsgSpace(4))
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			n, oobn, _, _, err := c.ReadMsgUnix(buf, oob)
+			must(err)
+			if string(buf[:n]) != "file" {
+				panic(fmt.Sprintf("expected 'file', got '%s'", buf[:n]))
+			}
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			must(err)
+			rights, err := syscall.ParseUnixRights(&msgs[0])
+			must(err)
+			r := os.NewFile(uintptr(rights[0]), "")
+			defer r.Close()
+			n, _ = r.Read(buf)
+			if string(buf[:n]) != "piped" {
+				panic(fmt.Sprintf("expected 'piped', got '%s'", buf[:n]))
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+sock))
+	if len(closedErrs) == 0 {
+		panic("expected closed connections")
+	}
+	for _, err := range closedErrs {
+		if err == nil {
+			panic("expected error")
+		}
+	}
+}
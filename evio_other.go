@@ -10,18 +10,21 @@ import (
 	"errors"
 	"net"
 	"os"
+	"strings"
 )
 
 func (ln *listener) close() {
-	if ln.ln != nil {
-		ln.ln.Close()
-	}
-	if ln.pconn != nil {
-		ln.pconn.Close()
-	}
-	if ln.network == "unix" {
-		os.RemoveAll(ln.addr)
-	}
+	ln.once.Do(func() {
+		if ln.ln != nil {
+			ln.ln.Close()
+		}
+		if ln.pconn != nil {
+			ln.pconn.Close()
+		}
+		if strings.HasPrefix(ln.network, "unix") && !isAbstract(ln.addr) {
+			os.RemoveAll(ln.addr)
+		}
+	})
 }
 
 func (ln *listener) system() error {
@@ -39,3 +42,46 @@ func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
 func reuseportListen(proto, addr string) (l net.Listener, err error) {
 	return nil, errors.New("reuseport is not available")
 }
+
+func restrictUmask(mask int) (old int, restore func()) {
+	return 0, func() {}
+}
+
+func listenMulticast(network, addr string, opts addrOpts) (net.PacketConn, error) {
+	gaddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	var ifi *net.Interface
+	if opts.iface != "" {
+		if ifi, err = net.InterfaceByName(opts.iface); err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenMulticastUDP(network, ifi, gaddr)
+}
+
+func joinGroup(pconn net.PacketConn, group net.IP, iface string, join bool) error {
+	return errors.New("multicast groups are not available")
+}
+
+func connPeerCredentials(conn net.Conn) *Credentials {
+	return nil
+}
+
+var maxRightsSpace = 0
+
+func connRead(conn net.Conn, p, oob []byte) (n int, files []*os.File, err error) {
+	n, err = conn.Read(p)
+	return n, nil, err
+}
+
+func connSendFiles(conn net.Conn, files []*os.File, payload []byte) error {
+	return errNotUnix
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
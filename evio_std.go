@@ -5,9 +5,11 @@
 package evio
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -20,12 +22,22 @@ var errCloseConns = errors.New("close conns")
 type stdserver struct {
 	events   Events         // user events
 	loops    []*stdloop     // all the loops
-	lns      []*listener    // all the listeners
+	lns      listenerList   // all the listeners
 	loopwg   sync.WaitGroup // loop close waitgroup
 	lnwg     sync.WaitGroup // listener close waitgroup
 	cond     *sync.Cond     // shutdown signaler
 	serr     error          // signal error
 	accepted uintptr        // accept counter
+	limits   connLimits     // connection limits
+	done     chan struct{}  // closed when the server is shutting down
+
+	pmu         sync.Mutex // guards the paused listeners
+	pcond       *sync.Cond // signals paused listeners
+	started     bool       // listeners are running
+	closing     bool       // listeners are closing
+	attaching   []*stdconn // attached before the loops are running
+	overConns   int32      // accepting paused by PauseAcceptConns
+	overLatency int32      // accepting paused by PauseAcceptLatency
 }
 
 type stdudpconn struct {
@@ -33,31 +45,84 @@ type stdudpconn struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
 	in         []byte
+	events     *Events     // events of the listener
+	ctx        interface{} // user-defined context
+	loop       *stdloop    // owner loop of the session
+	key        stdudpKey   // session key
+	seen       int64       // time the session received a datagram
+	ln         *listener   // listener of the session
+	frames     []byte      // partial frame of the Frame event
+}
+
+// stdudpKey identifies the UDP session of a remote address on a listener.
+type stdudpKey struct {
+	lnidx int
+	addr  string
 }
 
-func (c *stdudpconn) Context() interface{}       { return nil }
-func (c *stdudpconn) SetContext(ctx interface{}) {}
+type udpWakeReq struct {
+	c *stdudpconn
+}
+
+func (c *stdudpconn) Context() interface{}       { return c.ctx }
+func (c *stdudpconn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *stdudpconn) AddrIndex() int             { return c.addrIndex }
 func (c *stdudpconn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *stdudpconn) RemoteAddr() net.Addr       { return c.remoteAddr }
-func (c *stdudpconn) Wake()                      {}
+func (c *stdudpconn) MoveTo(loopIdx int)         {}
+func (c *stdudpconn) PeerCredentials() *Credentials {
+	return nil
+}
+func (c *stdudpconn) ReceivedFiles() []*os.File { return nil }
+func (c *stdudpconn) ProxyHeader() *ProxyHeader { return nil }
+func (c *stdudpconn) frameBuffer() *[]byte      { return &c.frames }
+func (c *stdudpconn) Input() *InputBuffer       { return nil }
+func (c *stdudpconn) TLSState() *tls.ConnectionState {
+	return nil
+}
+func (c *stdudpconn) SendFiles(files []*os.File, payload []byte) error {
+	return errNotUnix
+}
+func (c *stdudpconn) Send(b []byte) error {
+	if c.loop == nil {
+		return errNotSession
+	}
+	return stdudpWrite(c.ln, b, c.remoteAddr)
+}
+func (c *stdudpconn) Wake() {
+	if c.loop != nil {
+		c.loop.ch <- udpWakeReq{c}
+	}
+}
 
 type stdloop struct {
-	idx   int               // loop index
-	ch    chan interface{}  // command channel
-	conns map[*stdconn]bool // track all the conns bound to this loop
+	idx      int                       // loop index
+	ch       chan interface{}          // command channel
+	conns    map[*stdconn]bool         // track all the conns bound to this loop
+	udpconns map[stdudpKey]*stdudpconn // UDP sessions
+	probed   int64                     // time the pending latency probe was sent
+	latency  int64                     // time it took to respond to the last probe
 }
 
 type stdconn struct {
 	addrIndex  int
 	localAddr  net.Addr
 	remoteAddr net.Addr
-	conn       net.Conn    // original connection
-	ctx        interface{} // user-defined context
-	loop       *stdloop    // owner loop
-	lnidx      int         // index of listener
-	donein     []byte      // extra data for done connection
-	done       int32       // 0: attached, 1: closed, 2: detached
+	conn       net.Conn     // original connection
+	ctx        interface{}  // user-defined context
+	loop       *stdloop     // owner loop
+	lnidx      int          // index of listener
+	donein     []byte       // extra data for done connection
+	done       int32        // 0: attached, 1: closed, 2: detached
+	ip         string       // remote ip counted by the connection limits
+	events     *Events      // events of the listener
+	cred       *Credentials // unix socket peer credentials
+	files      []*os.File   // files received with the current input
+	attached   bool         // added by Attach
+	proxy      *ProxyHeader // PROXY protocol header
+	frames     []byte       // partial frame of the Frame event
+	inbuf      *InputBuffer // input of the MaxInputBuffer option
+	err        error        // error of the Closed event after a close
 }
 
 type wakeReq struct {
@@ -70,10 +135,37 @@ func (c *stdconn) AddrIndex() int             { return c.addrIndex }
 func (c *stdconn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *stdconn) RemoteAddr() net.Addr       { return c.remoteAddr }
 func (c *stdconn) Wake()                      { c.loop.ch <- wakeReq{c} }
+func (c *stdconn) MoveTo(loopIdx int)         {}
+func (c *stdconn) Send(b []byte) error        { return errNotSession }
+func (c *stdconn) PeerCredentials() *Credentials {
+	return c.cred
+}
+func (c *stdconn) ProxyHeader() *ProxyHeader { return c.proxy }
+func (c *stdconn) frameBuffer() *[]byte      { return &c.frames }
+func (c *stdconn) Input() *InputBuffer       { return c.inbuf }
+func (c *stdconn) TLSState() *tls.ConnectionState {
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+func (c *stdconn) ReceivedFiles() []*os.File {
+	files := c.files
+	c.files = nil
+	return files
+}
+func (c *stdconn) SendFiles(files []*os.File, payload []byte) error {
+	if len(payload) == 0 {
+		return errEmptyPayload
+	}
+	return connSendFiles(c.conn, files, payload)
+}
 
 type stdin struct {
-	c  *stdconn
-	in []byte
+	c     *stdconn
+	in    []byte
+	files []*os.File
 }
 
 type stderr struct {
@@ -81,6 +173,11 @@ type stderr struct {
 	err error
 }
 
+type stdaccepterr struct {
+	lnidx int
+	err   error
+}
+
 // waitForShutdown waits for a signal to shutdown
 func (s *stdserver) waitForShutdown() error {
 	s.cond.L.Lock()
@@ -110,12 +207,23 @@ func stdserve(events Events, listeners []*listener) error {
 
 	s := &stdserver{}
 	s.events = events
-	s.lns = listeners
+	setFrameData(&s.events)
+	for _, ln := range listeners {
+		if ln.events == nil {
+			ln.events = &s.events
+		}
+		s.lns.add(ln)
+	}
 	s.cond = sync.NewCond(&sync.Mutex{})
+	s.limits.maxConns = events.MaxConns
+	s.limits.maxPerIP = events.MaxConnsPerIP
+	s.done = make(chan struct{})
+	s.pcond = sync.NewCond(&s.pmu)
 
 	//println("-- server starting")
 	if events.Serving != nil {
 		var svr Server
+		svr.e = s
 		svr.NumLoops = numLoops
 		svr.Addrs = make([]net.Addr, len(listeners))
 		for i, ln := range listeners {
@@ -124,14 +232,24 @@ func stdserve(events Events, listeners []*listener) error {
 		action := events.Serving(svr)
 		switch action {
 		case Shutdown:
+			s.pmu.Lock()
+			s.closing = true
+			for _, c := range s.attaching {
+				c.conn.Close()
+			}
+			s.pmu.Unlock()
+			for _, ln := range s.lns.load() {
+				ln.close()
+			}
 			return nil
 		}
 	}
 	for i := 0; i < numLoops; i++ {
 		s.loops = append(s.loops, &stdloop{
-			idx:   i,
-			ch:    make(chan interface{}),
-			conns: make(map[*stdconn]bool),
+			idx:      i,
+			ch:       make(chan interface{}),
+			conns:    make(map[*stdconn]bool),
+			udpconns: make(map[stdudpKey]*stdudpconn),
 		})
 	}
 	var ferr error
@@ -146,10 +264,15 @@ func stdserve(events Events, listeners []*listener) error {
 
 		// wait on all loops to main loop channel events
 		s.loopwg.Wait()
+		close(s.done)
 
-		// shutdown all listeners
-		for i := 0; i < len(s.lns); i++ {
-			s.lns[i].close()
+		// wake up paused listeners and shutdown all listeners
+		s.pmu.Lock()
+		s.closing = true
+		s.pcond.Broadcast()
+		s.pmu.Unlock()
+		for _, ln := range s.lns.load() {
+			ln.close()
 		}
 
 		// wait on all listeners to complete
@@ -167,31 +290,311 @@ func stdserve(events Events, listeners []*listener) error {
 	for i := 0; i < numLoops; i++ {
 		go stdloopRun(s, s.loops[i])
 	}
-	s.lnwg.Add(len(listeners))
-	for i := 0; i < len(listeners); i++ {
-		go stdlistenerRun(s, listeners[i], i)
+	s.pmu.Lock()
+	lns := s.lns.load()
+	s.lnwg.Add(len(lns))
+	for i, ln := range lns {
+		go stdlistenerRun(s, ln, i)
+	}
+	for _, c := range s.attaching {
+		s.attachConn(c)
+	}
+	s.attaching = nil
+	s.started = true
+	s.pmu.Unlock()
+	if events.PauseAcceptLatency > 0 {
+		go stdlatencyRun(s)
+	}
+	if events.UDPSessions && events.UDPSessionTimeout > 0 {
+		go stdudpExpireRun(s)
 	}
 	return ferr
 }
 
+func (s *stdserver) stats() Stats {
+	return s.limits.stats()
+}
+
+func (s *stdserver) pauseAccept(addrIndex int, paused bool) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if setFlag(&ln.paused, paused) {
+		s.notifyPause()
+	}
+	return nil
+}
+
+func (s *stdserver) listen(addr string, events *Events) (int, error) {
+	ln, _, err := listen(addr)
+	if err != nil {
+		return -1, err
+	}
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if s.closing {
+		ln.close()
+		return -1, errClosing
+	}
+	if events != nil {
+		setFrameData(events)
+		ln.events = events
+	} else {
+		ln.events = &s.events
+	}
+	if err := checkTLS(ln, ln.events); err != nil {
+		ln.close()
+		return -1, err
+	}
+	idx := s.lns.add(ln)
+	if s.started {
+		s.lnwg.Add(1)
+		go stdlistenerRun(s, ln, idx)
+	}
+	return idx, nil
+}
+
+func (s *stdserver) attach(conn interface{}, addrIndex int, ctx interface{}) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if ln.pconn != nil {
+		return errNotStream
+	}
+	var nc net.Conn
+	var in []byte
+	switch v := conn.(type) {
+	case int:
+		f := os.NewFile(uintptr(v), "")
+		var err error
+		nc, err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case *os.File:
+		var err error
+		nc, err = net.FileConn(v)
+		v.Close()
+		if err != nil {
+			return err
+		}
+	case *detachedConn:
+		nc, in = v.Conn, v.in
+	case net.Conn:
+		nc = v
+	default:
+		return errAttach
+	}
+	c := &stdconn{conn: nc, lnidx: addrIndex, events: ln.events}
+	c.ctx = ctx
+	c.donein = in
+	c.attached = true
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if s.closing {
+		nc.Close()
+		return errClosing
+	}
+	if !s.started {
+		// the loops are not running yet
+		s.attaching = append(s.attaching, c)
+		return nil
+	}
+	s.attachConn(c)
+	return nil
+}
+
+// attachConn hands an attached connection to a loop.
+func (s *stdserver) attachConn(c *stdconn) {
+	c.loop = s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+	// the loop may be the caller
+	go func() { c.loop.ch <- c }()
+}
+
+func (s *stdserver) writeTo(addrIndex int, b []byte, addr net.Addr) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if ln.pconn == nil {
+		return errNotUDP
+	}
+	if atomic.LoadInt32(&ln.closed) == 1 {
+		return errListenerClosed
+	}
+	return stdudpWrite(ln, b, addr)
+}
+
+func (s *stdserver) joinGroup(addrIndex int, group net.IP, iface string,
+	join bool) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if ln.pconn == nil {
+		return errNotUDP
+	}
+	if atomic.LoadInt32(&ln.closed) == 1 {
+		return errListenerClosed
+	}
+	return joinGroup(ln.pconn, group, iface, join)
+}
+
+func (s *stdserver) closeListener(addrIndex int) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if s.closing {
+		return errClosing
+	}
+	if !setFlag(&ln.closed, true) {
+		return errListenerClosed
+	}
+	ln.close()
+	s.pcond.Broadcast()
+	if s.started && ln.pconn != nil && s.events.UDPSessions {
+		// close the sessions in the owner loop
+		l := s.loops[addrIndex%len(s.loops)]
+		go func() {
+			select {
+			case l.ch <- closeNote{ln}:
+			case <-s.done:
+			}
+		}()
+	}
+	return nil
+}
+
+// acceptPaused returns true if accepting is paused for the listener.
+func (s *stdserver) acceptPaused(ln *listener) bool {
+	auto := atomic.LoadInt32(&s.overConns) == 1 ||
+		atomic.LoadInt32(&s.overLatency) == 1
+	return atomic.LoadInt32(&ln.paused) == 1 || (auto && ln.pconn == nil)
+}
+
+// notifyPause interrupts the listeners that are now paused by setting a
+// deadline in the past, and wakes up the listeners that are resumed.
+func (s *stdserver) notifyPause() {
+	s.pmu.Lock()
+	for _, ln := range s.lns.load() {
+		if !ln.deadline && s.acceptPaused(ln) {
+			stdlistenerDeadline(ln, time.Now())
+			ln.deadline = true
+		}
+	}
+	s.pcond.Broadcast()
+	s.pmu.Unlock()
+}
+
+// waitAccept blocks while accepting is paused for the listener.
+func (s *stdserver) waitAccept(ln *listener) {
+	s.pmu.Lock()
+	for !s.closing && atomic.LoadInt32(&ln.closed) == 0 && s.acceptPaused(ln) {
+		s.pcond.Wait()
+	}
+	if ln.deadline {
+		stdlistenerDeadline(ln, time.Time{})
+		ln.deadline = false
+	}
+	s.pmu.Unlock()
+}
+
+// checkConns pauses or resumes accepting when the number of open
+// connections crosses the PauseAcceptConns threshold.
+func (s *stdserver) checkConns() {
+	if s.events.PauseAcceptConns > 0 {
+		n := atomic.LoadInt64(&s.limits.conns)
+		if setFlag(&s.overConns, n >= int64(s.events.PauseAcceptConns)) {
+			s.notifyPause()
+		}
+	}
+}
+
+func stdlistenerDeadline(ln *listener, t time.Time) {
+	if ln.pconn != nil {
+		ln.pconn.SetReadDeadline(t)
+	} else if ln, ok := ln.ln.(interface{ SetDeadline(time.Time) error }); ok {
+		ln.SetDeadline(t)
+	}
+}
+
+// stdlatencyRun periodically probes the loops and pauses accepting while any
+// of them takes longer than PauseAcceptLatency to respond.
+func stdlatencyRun(s *stdserver) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(pauseInterval):
+		}
+		var over bool
+		now := time.Now().UnixNano()
+		for _, l := range s.loops {
+			latency := atomic.LoadInt64(&l.latency)
+			if sent := atomic.LoadInt64(&l.probed); sent != 0 {
+				// the previous probe is still pending
+				latency = now - sent
+			} else {
+				atomic.StoreInt64(&l.probed, now)
+				go func(l *stdloop) {
+					select {
+					case l.ch <- latencyProbe{}:
+					case <-s.done:
+					}
+				}(l)
+			}
+			if time.Duration(latency) > s.events.PauseAcceptLatency {
+				over = true
+			}
+		}
+		if setFlag(&s.overLatency, over) {
+			s.notifyPause()
+		}
+	}
+}
+
 func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
 	var ferr error
 	defer func() {
-		s.signalShutdown(ferr)
+		if atomic.LoadInt32(&ln.closed) == 0 {
+			s.signalShutdown(ferr)
+		}
 		s.lnwg.Done()
 	}()
 	var packet [0xFFFF]byte
+	var tempDelay time.Duration
 	for {
+		s.waitAccept(ln)
 		if ln.pconn != nil {
 			// udp
 			n, addr, err := ln.pconn.ReadFrom(packet[:])
 			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue // paused
+				}
 				ferr = err
 				return
 			}
-			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			if addr == nil {
+				// unixgram datagram from an unbound socket
+				addr = &net.UnixAddr{Net: ln.network}
+			}
+			var l *stdloop
+			if s.events.UDPSessions {
+				// the sessions of an address are owned by a single loop
+				l = s.loops[lnidx%len(s.loops)]
+			} else {
+				l = s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			}
 			l.ch <- &stdudpconn{
 				addrIndex:  lnidx,
+				events:     ln.events,
 				localAddr:  ln.lnaddr,
 				remoteAddr: addr,
 				in:         append([]byte{}, packet[:n]...),
@@ -200,28 +603,127 @@ func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
 			// tcp
 			conn, err := ln.ln.Accept()
 			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue // paused
+				}
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					// report the error and back off before trying again,
+					// such as when the process is out of file descriptors.
+					l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+					l.ch <- &stdaccepterr{lnidx, err}
+					if tempDelay == 0 {
+						tempDelay = 5 * time.Millisecond
+					} else if tempDelay *= 2; tempDelay > time.Second {
+						tempDelay = time.Second
+					}
+					time.Sleep(tempDelay)
+					continue
+				}
 				ferr = err
 				return
 			}
+			tempDelay = 0
+			// the accept may have completed after a pause, so hold the
+			// connection until accepting resumes.
+			s.waitAccept(ln)
+			// counted before the connection is handed to a loop, so
+			// accepting pauses at the PauseAcceptConns threshold before
+			// the next accept, and a handshake counts for the peer.
+			ip, ok := s.limits.admit(ln, conn.RemoteAddr())
+			if !ok {
+				conn.Close()
+				continue
+			}
+			s.checkConns()
+			if ln.opts.proxy || ln.opts.tls {
+				go stdhandshakeRun(s, ln, lnidx, conn, ip)
+				continue
+			}
 			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
-			c := &stdconn{conn: conn, loop: l, lnidx: lnidx}
-			l.ch <- c
-			go func(c *stdconn) {
-				var packet [0xFFFF]byte
-				for {
-					n, err := c.conn.Read(packet[:])
-					if err != nil {
-						c.conn.SetReadDeadline(time.Time{})
-						l.ch <- &stderr{c, err}
-						return
-					}
-					l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
-				}
-			}(c)
+			l.ch <- &stdconn{conn: conn, loop: l, lnidx: lnidx, events: ln.events,
+				ip: ip}
 		}
 	}
 }
 
+// stdhandshakeRun reads the PROXY protocol header and does the TLS handshake
+// of a connection, and then hands the connection to a loop. The connection
+// is closed if the header is malformed or the handshake fails. The
+// connection was counted by the limits for the ip of the peer.
+func stdhandshakeRun(s *stdserver, ln *listener, lnidx int, conn net.Conn,
+	ip string) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	fail := func() {
+		// released before the peer sees the close
+		s.limits.release(ln, ip)
+		s.checkConns()
+		conn.Close()
+	}
+	var hdr *ProxyHeader
+	var in []byte
+	if ln.opts.proxy {
+		var ok bool
+		conn.SetReadDeadline(time.Now().Add(ln.opts.proxyTimeout))
+		if hdr, in, ok = stdreadProxy(conn); !ok {
+			s.limits.drop()
+			fail()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	events := ln.events
+	if ln.opts.tls {
+		tc := tls.Server(&detachedConn{conn, in}, ln.tlsConfig())
+		conn.SetDeadline(time.Now().Add(ln.opts.tlsTimeout))
+		if err := tc.Handshake(); err != nil {
+			fail()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		conn, in = tc, nil
+		events = ln.tlsEvents(tc.ConnectionState())
+	}
+	l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+	c := &stdconn{conn: conn, loop: l, lnidx: lnidx, events: events,
+		proxy: hdr, donein: in, ip: ip}
+	select {
+	case l.ch <- c:
+	case <-s.done:
+		fail()
+	}
+}
+
+// stdreadProxy reads the PROXY protocol header of a connection. It returns
+// the header and the data that followed it, or false if the header is
+// malformed.
+func stdreadProxy(conn net.Conn) (hdr *ProxyHeader, in []byte, ok bool) {
+	var buf []byte
+	packet := make([]byte, 512)
+	for {
+		n, err := conn.Read(packet)
+		if err != nil {
+			return nil, nil, false
+		}
+		buf = append(buf, packet[:n]...)
+		hdr, hn, err := parseProxyHeader(buf)
+		if err == errProxyShort {
+			continue
+		}
+		if err != nil {
+			return nil, nil, false
+		}
+		return hdr, buf[hn:], true
+	}
+}
+
 func stdloopRun(s *stdserver, l *stdloop) {
 	var err error
 	tick := make(chan bool)
@@ -269,13 +771,26 @@ func stdloopRun(s *stdserver, l *stdloop) {
 			case *stdconn:
 				err = stdloopAccept(s, l, v)
 			case *stdin:
-				err = stdloopRead(s, l, v.c, v.in)
+				err = stdloopRead(s, l, v.c, v.in, v.files)
 			case *stdudpconn:
 				err = stdloopReadUDP(s, l, v)
 			case *stderr:
 				err = stdloopError(s, l, v.c, v.err)
+			case *stdaccepterr:
+				err = stdloopAcceptError(s, l, v.lnidx, v.err)
+			case latencyProbe:
+				if sent := atomic.LoadInt64(&l.probed); sent != 0 {
+					atomic.StoreInt64(&l.latency, time.Now().UnixNano()-sent)
+					atomic.StoreInt64(&l.probed, 0)
+				}
 			case wakeReq:
-				err = stdloopRead(s, l, v.c, nil)
+				err = stdloopRead(s, l, v.c, nil, nil)
+			case udpWakeReq:
+				err = stdloopUDPWake(s, l, v.c)
+			case udpExpireNote:
+				err = stdloopUDPExpire(s, l)
+			case closeNote:
+				err = stdloopUDPCloseListener(s, l, v.ln)
 			}
 		}
 		if err != nil {
@@ -284,6 +799,24 @@ func stdloopRun(s *stdserver, l *stdloop) {
 	}
 }
 
+func stdconnRun(c *stdconn, l *stdloop) {
+	var packet [0xFFFF]byte
+	var oob []byte
+	if _, ok := c.conn.(*net.UnixConn); ok {
+		oob = make([]byte, maxRightsSpace)
+	}
+	for {
+		n, files, err := connRead(c.conn, packet[:], oob)
+		if err != nil {
+			closeFiles(files)
+			c.conn.SetReadDeadline(time.Time{})
+			l.ch <- &stderr{c, err}
+			return
+		}
+		l.ch <- &stdin{c, append([]byte{}, packet[:n]...), files}
+	}
+}
+
 func stdloopEgress(s *stdserver, l *stdloop) {
 	var closed bool
 loop:
@@ -295,6 +828,9 @@ loop:
 				for c := range l.conns {
 					stdloopClose(s, l, c)
 				}
+				for _, c := range l.udpconns {
+					stdloopUDPClose(s, l, c, nil)
+				}
 			}
 		case *stderr:
 			stdloopError(s, l, v.c, v.err)
@@ -307,6 +843,8 @@ loop:
 
 func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 	delete(l.conns, c)
+	s.limits.release(s.lns.get(c.lnidx), c.ip)
+	s.checkConns()
 	closeEvent := true
 	switch atomic.LoadInt32(&c.done) {
 	case 0: // read error
@@ -316,22 +854,26 @@ func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 		}
 	case 1: // closed
 		c.conn.Close()
-		err = nil
+		err = c.err
 	case 2: // detached
 		err = nil
-		if s.events.Detached == nil {
+		if c.events.Detached == nil {
 			c.conn.Close()
 		} else {
 			closeEvent = false
-			switch s.events.Detached(c, &stddetachedConn{c.conn, c.donein}) {
+			in := c.donein
+			if c.inbuf != nil && c.inbuf.Len() > 0 {
+				in = append(append([]byte{}, c.inbuf.Bytes()...), in...)
+			}
+			switch c.events.Detached(c, &detachedConn{c.conn, in}) {
 			case Shutdown:
 				return errClosing
 			}
 		}
 	}
 	if closeEvent {
-		if s.events.Closed != nil {
-			switch s.events.Closed(c, err) {
+		if c.events.Closed != nil {
+			switch c.events.Closed(c, err) {
 			case Shutdown:
 				return errClosing
 			}
@@ -340,48 +882,31 @@ func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 	return nil
 }
 
-type stddetachedConn struct {
-	conn net.Conn // original conn
-	in   []byte   // extra input data
-}
-
-func (c *stddetachedConn) Read(p []byte) (n int, err error) {
-	if len(c.in) > 0 {
-		if len(c.in) <= len(p) {
-			copy(p, c.in)
-			n = len(c.in)
-			c.in = nil
-			return
-		}
-		copy(p, c.in[:len(p)])
-		n = len(p)
-		c.in = c.in[n:]
-		return
-	}
-	return c.conn.Read(p)
-}
-
-func (c *stddetachedConn) Write(p []byte) (n int, err error) {
-	return c.conn.Write(p)
-}
-
-func (c *stddetachedConn) Close() error {
-	return c.conn.Close()
-}
-
-func (c *stddetachedConn) Wake() {}
-
-func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
+func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte,
+	files []*os.File) error {
 	if atomic.LoadInt32(&c.done) == 2 {
 		// should not ignore reads for detached connections
 		c.donein = append(c.donein, in...)
+		closeFiles(files)
 		return nil
 	}
-	if s.events.Data != nil {
-		out, action := s.events.Data(c, in)
+	c.files = files
+	defer func() {
+		closeFiles(c.files)
+		c.files = nil
+	}()
+	if c.inbuf != nil {
+		if !c.inbuf.write(in) {
+			c.err = &InputLimitError{c.inbuf.max}
+			return stdloopClose(s, l, c)
+		}
+		in = c.inbuf.Bytes()
+	}
+	if c.events.Data != nil {
+		out, action := c.events.Data(c, in)
 		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
+			if c.events.PreWrite != nil {
+				c.events.PreWrite()
 			}
 			c.conn.Write(out)
 		}
@@ -398,13 +923,16 @@ func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
 }
 
 func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
-	if s.events.Data != nil {
-		out, action := s.events.Data(c, c.in)
+	if s.events.UDPSessions {
+		return stdloopUDPSession(s, l, c)
+	}
+	if c.events.Data != nil {
+		out, action := c.events.Data(c, c.in)
 		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
+			if c.events.PreWrite != nil {
+				c.events.PreWrite()
 			}
-			s.lns[c.addrIndex].pconn.WriteTo(out, c.remoteAddr)
+			stdudpWrite(s.lns.get(c.addrIndex), out, c.remoteAddr)
 		}
 		switch action {
 		case Shutdown:
@@ -414,6 +942,146 @@ func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
 	return nil
 }
 
+// stdudpWrite writes a datagram. With the gso option, data larger than the
+// segment size is split into multiple datagrams.
+func stdudpWrite(ln *listener, b []byte, addr net.Addr) error {
+	size := ln.opts.gso
+	if size <= 0 || size > len(b) {
+		size = len(b)
+	}
+	for {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := ln.pconn.WriteTo(b[:n], addr); err != nil {
+			return err
+		}
+		if b = b[n:]; len(b) == 0 {
+			return nil
+		}
+	}
+}
+
+// stdloopUDPSession handles a datagram for the session of the remote
+// address, and opens the session on the first datagram.
+func stdloopUDPSession(s *stdserver, l *stdloop, p *stdudpconn) error {
+	key := stdudpKey{p.addrIndex, p.remoteAddr.String()}
+	c := l.udpconns[key]
+	if c == nil {
+		ln := s.lns.get(p.addrIndex)
+		max := s.events.UDPMaxSessions
+		if max > 0 && atomic.LoadInt64(&ln.sessions) >= int64(max) {
+			return nil // session table is full, drop the datagram
+		}
+		c = p
+		c.loop = l
+		c.ln = ln
+		c.key = key
+		l.udpconns[key] = c
+		atomic.AddInt64(&ln.sessions, 1)
+		if c.events.Opened != nil {
+			out, _, action := c.events.Opened(c)
+			if err := stdloopUDPAction(s, l, c, out, action); err != nil {
+				return err
+			}
+			if l.udpconns[key] != c {
+				return nil // closed by the Opened event
+			}
+		}
+	}
+	c.seen = time.Now().UnixNano()
+	if c.events.Data != nil {
+		out, action := c.events.Data(c, p.in)
+		return stdloopUDPAction(s, l, c, out, action)
+	}
+	return nil
+}
+
+// stdloopUDPAction sends the output of an event to the remote address of
+// the session and applies the action.
+func stdloopUDPAction(s *stdserver, l *stdloop, c *stdudpconn, out []byte,
+	action Action) error {
+	if len(out) > 0 {
+		if c.events.PreWrite != nil {
+			c.events.PreWrite()
+		}
+		stdudpWrite(s.lns.get(c.addrIndex), out, c.remoteAddr)
+	}
+	switch action {
+	case Shutdown:
+		return errClosing
+	case Close, Detach:
+		return stdloopUDPClose(s, l, c, nil)
+	}
+	return nil
+}
+
+func stdloopUDPWake(s *stdserver, l *stdloop, c *stdudpconn) error {
+	if l.udpconns[c.key] != c || c.events.Data == nil {
+		return nil // ignore wakes for closed sessions
+	}
+	out, action := c.events.Data(c, nil)
+	return stdloopUDPAction(s, l, c, out, action)
+}
+
+func stdloopUDPClose(s *stdserver, l *stdloop, c *stdudpconn, err error) error {
+	delete(l.udpconns, c.key)
+	atomic.AddInt64(&s.lns.get(c.addrIndex).sessions, -1)
+	if c.events.Closed != nil {
+		switch c.events.Closed(c, err) {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// stdloopUDPCloseListener closes the sessions of a closed listener.
+func stdloopUDPCloseListener(s *stdserver, l *stdloop, ln *listener) error {
+	for _, c := range l.udpconns {
+		if s.lns.get(c.addrIndex) == ln {
+			if err := stdloopUDPClose(s, l, c, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stdloopUDPExpire closes the sessions that have been idle for longer than
+// UDPSessionTimeout.
+func stdloopUDPExpire(s *stdserver, l *stdloop) error {
+	idle := time.Now().UnixNano() - int64(s.events.UDPSessionTimeout)
+	for _, c := range l.udpconns {
+		if c.seen < idle {
+			if err := stdloopUDPClose(s, l, c, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stdudpExpireRun periodically asks the loops to close the expired UDP
+// sessions.
+func stdudpExpireRun(s *stdserver) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(udpExpireInterval(s.events.UDPSessionTimeout)):
+		}
+		for _, l := range s.loops {
+			select {
+			case l.ch <- udpExpireNote{}:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
 func stdloopDetach(s *stdserver, l *stdloop, c *stdconn) error {
 	atomic.StoreInt32(&c.done, 2)
 	c.conn.SetReadDeadline(time.Now())
@@ -426,17 +1094,68 @@ func stdloopClose(s *stdserver, l *stdloop, c *stdconn) error {
 	return nil
 }
 
+func stdloopAcceptError(s *stdserver, l *stdloop, lnidx int, err error) error {
+	if s.lns.get(lnidx).events.AcceptError != nil {
+		switch s.lns.get(lnidx).events.AcceptError(lnidx, err) {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
 func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
+	ln := s.lns.get(c.lnidx)
+	// an attached connection may have input that was read before it was
+	// detached.
+	in := c.donein
+	c.donein = nil
+	c.remoteAddr = c.conn.RemoteAddr()
+	if c.proxy != nil && c.proxy.Source != nil {
+		c.remoteAddr = c.proxy.Source
+	}
+	ok := true
+	var err error
+	// an accepted connection was counted for its peer by the accept loop
+	switch {
+	case c.attached:
+		s.limits.add(ln)
+	case c.proxy != nil:
+		c.ip, ok = s.limits.readmit(ln, c.ip, c.remoteAddr)
+	}
+	if ok && !c.attached && ln.events.Accepting != nil {
+		switch ln.events.Accepting(c.remoteAddr, c.lnidx) {
+		case None:
+		case Shutdown:
+			err = errClosing
+			fallthrough
+		default:
+			s.limits.reject(ln, c.ip)
+			ok = false
+		}
+	}
+	if !ok {
+		c.conn.Close()
+		return err
+	}
 	l.conns[c] = true
+	go stdconnRun(c, l)
+	s.checkConns()
 	c.addrIndex = c.lnidx
-	c.localAddr = s.lns[c.lnidx].lnaddr
-	c.remoteAddr = c.conn.RemoteAddr()
+	c.localAddr = c.conn.LocalAddr()
+	if c.proxy != nil && c.proxy.Destination != nil {
+		c.localAddr = c.proxy.Destination
+	}
+	if _, ok := c.conn.(*net.UnixConn); ok {
+		c.cred = connPeerCredentials(c.conn)
+	}
+	c.inbuf = newInputBuffer(c.events)
 
-	if s.events.Opened != nil {
-		out, opts, action := s.events.Opened(c)
+	if c.events.Opened != nil {
+		out, opts, action := c.events.Opened(c)
 		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
+			if c.events.PreWrite != nil {
+				c.events.PreWrite()
 			}
 			c.conn.Write(out)
 		}
@@ -455,5 +1174,8 @@ func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
 			return stdloopClose(s, l, c)
 		}
 	}
+	if len(in) > 0 {
+		return stdloopRead(s, l, c, in, nil)
+	}
 	return nil
 }
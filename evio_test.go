@@ -6,8 +6,16 @@ package evio
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net"
 	"os"
@@ -16,6 +24,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/tidwall/evio/codec"
 )
 
 func TestServe(t *testing.T) {
@@ -399,6 +409,22 @@ func TestBadAddresses(t *testing.T) {
 	if err := Serve(events, "tcp://"); err != nil {
 		t.Fatalf("expected nil, got '%v'", err)
 	}
+	// options with invalid values
+	for addr, expect := range map[string]error{
+		"unix://evio-bad.sock?mode=0o660":            errModeOption,
+		"unix://evio-bad.sock?mode=rw":               errModeOption,
+		"unix://evio-bad.sock?mode=1777":             errModeOption,
+		"udp://:9983?multicast=true&ttl=256":         errTTLOption,
+		"udp://:9983?multicast=true&ttl=x":           errTTLOption,
+		"tcp://:9983?proxyprotocol=1&proxytimeout=5": errTimeoutOption,
+		"tcp://:9983?tls=1&tlstimeout=soon":          errTimeoutOption,
+		"unixgram://evio-bad.sock?gso=1200":          errNotUDP,
+		"unixgram://evio-bad.sock?gro=true":          errNotUDP,
+	} {
+		if err := Serve(events, addr); err != expect {
+			t.Fatalf("%s: expected '%v', got '%v'", addr, expect, err)
+		}
+	}
 }
 
 func TestInputStream(t *testing.T) {
@@ -476,3 +502,1431 @@ func TestReuseport(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestMoveTo(t *testing.T) {
+	var events Events
+	events.NumLoops = 2
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext(0)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			// woken after a move
+			return []byte("woke\n"), None
+		}
+		n := c.Context().(int) + 1
+		c.SetContext(n)
+		c.MoveTo(n % 2)
+		c.Wake()
+		return []byte(fmt.Sprintf("%d:%s", n, in)), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9981")
+			must(err)
+			defer c.Close()
+			rd := bufio.NewReader(c)
+			for i := 1; i <= 5; i++ {
+				fmt.Fprintf(c, "hello\n")
+				for _, expect := range []string{
+					fmt.Sprintf("%d:hello\n", i), "woke\n",
+				} {
+					line, err := rd.ReadString('\n')
+					must(err)
+					if line != expect {
+						panic(fmt.Sprintf("expected %q, got %q", expect, line))
+					}
+				}
+			}
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if c.Context().(int) != 5 {
+			t.Fatalf("expected 5, got %v", c.Context())
+		}
+		return Shutdown
+	}
+	must(Serve(events, "tcp://:9981"))
+}
+
+func TestMoveToWake(t *testing.T) {
+	const wakes = 200
+	var woken int32
+	conns := make(chan Conn, 1)
+	var events Events
+	events.NumLoops = 3
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		conns <- c
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			if atomic.AddInt32(&woken, 1) == wakes {
+				return []byte("done\n"), None
+			}
+			return
+		}
+		c.MoveTo(int(in[0]-'0') % 3)
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9981")
+			must(err)
+			defer c.Close()
+			sc := <-conns
+			done := make(chan bool)
+			go func() {
+				// moves from the loop and from this goroutine, while the
+				// connection is woken
+				for i := 0; i < wakes; i++ {
+					c.Write([]byte{byte('0' + i%10)})
+					sc.MoveTo(i % 3)
+					time.Sleep(time.Millisecond / 10)
+				}
+				done <- true
+			}()
+			for i := 0; i < wakes; i++ {
+				sc.Wake()
+			}
+			<-done
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			line, err := bufio.NewReader(c).ReadString('\n')
+			must(err)
+			if line != "done\n" {
+				panic(fmt.Sprintf("expected 'done', got '%s'", line))
+			}
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	must(Serve(events, "tcp://:9981"))
+}
+
+func TestAdmission(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAdmission(t, "tcp", ":9983", ":9984")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAdmission(t, "tcp-net", ":9985", ":9986")
+	})
+}
+
+func testAdmission(t *testing.T, network, addr1, addr2 string) {
+	var events Events
+	events.MaxConnsPerIP = 3
+	events.Accepting = func(remote net.Addr, addrIndex int) (action Action) {
+		if remote == nil {
+			panic("nil remote addr")
+		}
+		if addrIndex == 1 {
+			action = Close
+		}
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hello\n"), opts, None
+	}
+	var stats atomic.Value
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			dial := func(addr string) (accepted bool) {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				_, err = bufio.NewReader(c).ReadString('\n')
+				if err != nil {
+					c.Close()
+					return false
+				}
+				return true
+			}
+			// two accepted, one over the listener limit
+			for i, expect := range []bool{true, true, false} {
+				if accepted := dial(addr1); accepted != expect {
+					panic(fmt.Sprintf("conn %d: expected %v, got %v", i, expect, accepted))
+				}
+			}
+			// rejected by the accepting event
+			if dial(addr2) {
+				panic("expected rejection")
+			}
+			stats.Store(srv.Stats())
+		}()
+		return
+	}
+	events.Tick = func() (delay time.Duration, action Action) {
+		if stats.Load() != nil {
+			action = Shutdown
+		}
+		return time.Second / 20, action
+	}
+	must(Serve(events, network+"://"+addr1+"?maxconns=2", network+"://"+addr2))
+	if stats := stats.Load().(Stats); stats.Conns != 2 || stats.Rejected != 2 {
+		t.Fatalf("expected 2 conns and 2 rejected, got %+v", stats)
+	}
+}
+
+func TestServerNotRunning(t *testing.T) {
+	var srv Server
+	if stats := srv.Stats(); stats != (Stats{}) {
+		t.Fatalf("expected zero stats, got %+v", stats)
+	}
+	_, lerr := srv.Listen("tcp://:9983")
+	_, eerr := srv.ListenEvents("tcp://:9983", Events{})
+	for i, err := range []error{
+		srv.PauseAccept(0), srv.ResumeAccept(0), lerr, eerr,
+		srv.CloseListener(0), srv.JoinGroup(0, net.IPv4(239, 1, 2, 3), ""),
+		srv.LeaveGroup(0, net.IPv4(239, 1, 2, 3), ""),
+		srv.WriteTo(0, []byte("x"), &net.UDPAddr{}), srv.Attach(-1, 0, nil),
+	} {
+		if err != errNotRunning {
+			t.Fatalf("%d: expected '%v', got '%v'", i, errNotRunning, err)
+		}
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	var lim connLimits
+	lim.maxConns = 3
+	lim.maxPerIP = 2
+	var ln listener
+	addr1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}
+	addr2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}
+	ip1, ok := lim.admit(&ln, addr1)
+	if !ok {
+		t.Fatal("expected ok")
+	}
+	if _, ok := lim.admit(&ln, addr1); !ok {
+		t.Fatal("expected ok")
+	}
+	if _, ok := lim.admit(&ln, addr1); ok {
+		t.Fatal("expected per-ip limit")
+	}
+	if _, ok := lim.admit(&ln, addr2); !ok {
+		t.Fatal("expected ok")
+	}
+	if _, ok := lim.admit(&ln, addr2); ok {
+		t.Fatal("expected server limit")
+	}
+	lim.release(&ln, ip1)
+	if _, ok := lim.admit(&ln, addr1); !ok {
+		t.Fatal("expected ok")
+	}
+	if stats := lim.stats(); stats.Conns != 3 || stats.Rejected != 2 {
+		t.Fatalf("expected 3 conns and 2 rejected, got %+v", stats)
+	}
+}
+
+func TestPauseAccept(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testPauseAccept("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testPauseAccept("tcp-net", ":9984")
+	})
+}
+
+func testPauseAccept(network, addr string) {
+	var events Events
+	events.PauseAcceptConns = 1
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hello\n"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	// accepted returns true if the server accepts the connection in time.
+	accepted := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(time.Second / 5))
+		defer c.SetReadDeadline(time.Time{})
+		_, err := bufio.NewReader(c).ReadString('\n')
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return false
+		}
+		must(err)
+		return true
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			must(srv.PauseAccept(0))
+			c1, err := net.Dial("tcp", addr)
+			must(err)
+			if accepted(c1) {
+				panic("expected paused")
+			}
+			must(srv.ResumeAccept(0))
+			if !accepted(c1) {
+				panic("expected accepted")
+			}
+			// paused by PauseAcceptConns until c1 closes
+			c2, err := net.Dial("tcp", addr)
+			must(err)
+			defer c2.Close()
+			if accepted(c2) {
+				panic("expected paused")
+			}
+			c1.Close()
+			if !accepted(c2) {
+				panic("expected accepted")
+			}
+			// a backlog of connections is accepted one at a time
+			var backlog []net.Conn
+			for i := 0; i < 4; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				backlog = append(backlog, c)
+			}
+			c2.Close()
+			if !accepted(backlog[0]) {
+				panic("expected accepted")
+			}
+			time.Sleep(time.Second / 10)
+			if n := srv.Stats().Conns; n != 1 {
+				panic(fmt.Sprintf("expected 1 conn, got %d", n))
+			}
+			backlog[0].Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestListen(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testListen("tcp", ":9983", ":9985")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testListen("tcp-net", ":9984", ":9986")
+	})
+}
+
+func testListen(network, addr1, addr2 string) {
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte(fmt.Sprintf("%d\n", c.AddrIndex())), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	// dial connects to the addr and returns the AddrIndex of the connection.
+	dial := func(addr string) (net.Conn, string) {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		line, err := bufio.NewReader(c).ReadString('\n')
+		must(err)
+		return c, strings.TrimSpace(line)
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			idx, err := srv.Listen(network + "://" + addr2)
+			must(err)
+			if idx != 1 {
+				panic(fmt.Sprintf("expected index 1, got %d", idx))
+			}
+			c, n := dial(addr2)
+			if n != "1" {
+				panic(fmt.Sprintf("expected index 1, got %s", n))
+			}
+			must(srv.CloseListener(1))
+			if srv.CloseListener(1) == nil {
+				panic("expected error")
+			}
+			// the open connection is not affected
+			c.Write([]byte("hello"))
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(c, buf)
+			must(err)
+			c.Close()
+			for start := time.Now(); ; {
+				c, err := net.Dial("tcp", addr2)
+				if err != nil {
+					break
+				}
+				c.Close()
+				if time.Since(start) > time.Second {
+					panic("expected closed listener")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			idx, err = srv.Listen(network + "://" + addr2)
+			must(err)
+			if idx != 2 {
+				panic(fmt.Sprintf("expected index 2, got %d", idx))
+			}
+			c, n = dial(addr2)
+			if n != "2" {
+				panic(fmt.Sprintf("expected index 2, got %s", n))
+			}
+			c.Write([]byte("shutdown"))
+			c.Close()
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr1))
+}
+
+func TestServeMux(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testServeMux("tcp", ":9983", ":9985", ":9987")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testServeMux("tcp-net", ":9984", ":9986", ":9988")
+	})
+}
+
+func testServeMux(network, addr1, addr2, addr3 string) {
+	var mux ServeMux
+	var admin, public, metrics Events
+	admin.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte(fmt.Sprintf("admin %d\n", c.AddrIndex())), opts, None
+	}
+	admin.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	public.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte(fmt.Sprintf("public %d\n", c.AddrIndex())), opts, None
+	}
+	metrics.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte(fmt.Sprintf("metrics %d\n", c.AddrIndex())), opts, None
+	}
+	mux.Bind(network+"://"+addr1, admin)
+	mux.Bind(network+"://"+addr2, public)
+	// greeting connects to the addr and returns the first line.
+	greeting := func(addr string) (net.Conn, string) {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		line, err := bufio.NewReader(c).ReadString('\n')
+		must(err)
+		return c, strings.TrimSpace(line)
+	}
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, line := greeting(addr2)
+			if line != "public 1" {
+				panic(fmt.Sprintf("expected 'public 1', got '%s'", line))
+			}
+			c.Close()
+			// an address that is added at runtime with its own events
+			idx, err := srv.ListenEvents(network+"://"+addr3, metrics)
+			must(err)
+			c, line = greeting(addr3)
+			if line != fmt.Sprintf("metrics %d", idx) {
+				panic(fmt.Sprintf("expected 'metrics %d', got '%s'", idx, line))
+			}
+			c.Close()
+			c, line = greeting(addr1)
+			if line != "admin 0" {
+				panic(fmt.Sprintf("expected 'admin 0', got '%s'", line))
+			}
+			c.Write([]byte("shutdown"))
+			c.Close()
+		}()
+		return
+	}
+	must(mux.Serve(events))
+}
+
+func TestUDPSessions(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPSessions(t, "udp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPSessions(t, "udp-net", ":9984")
+	})
+}
+
+func testUDPSessions(t *testing.T, network, addr string) {
+	var closed int32
+	var events Events
+	events.NumLoops = 2
+	events.LoadBalance = RoundRobin
+	events.UDPSessions = true
+	events.UDPSessionTimeout = time.Second / 5
+	events.UDPMaxSessions = 1
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext(0)
+		return []byte("opened"), opts, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		atomic.AddInt32(&closed, 1)
+		return None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		// a session stays on its loop
+		c.MoveTo(1)
+		n := c.Context().(int) + 1
+		c.SetContext(n)
+		return []byte(fmt.Sprintf("%d", n)), None
+	}
+	// read returns the next datagram, or an empty string on timeout.
+	read := func(c net.Conn) string {
+		c.SetReadDeadline(time.Now().Add(time.Second / 5))
+		buf := make([]byte, 64)
+		n, err := c.Read(buf)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return ""
+		}
+		must(err)
+		return string(buf[:n])
+	}
+	// send writes a datagram and returns the responses.
+	send := func(c net.Conn, msg string, nres int) string {
+		_, err := c.Write([]byte(msg))
+		must(err)
+		var res []string
+		for i := 0; i < nres; i++ {
+			res = append(res, read(c))
+		}
+		return strings.Join(res, ",")
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c1, err := net.Dial("udp", addr)
+			must(err)
+			defer c1.Close()
+			if res := send(c1, "a", 2); res != "opened,1" {
+				panic(fmt.Sprintf("expected 'opened,1', got '%s'", res))
+			}
+			if res := send(c1, "b", 1); res != "2" {
+				panic(fmt.Sprintf("expected '2', got '%s'", res))
+			}
+			// the session table is full
+			c2, err := net.Dial("udp", addr)
+			must(err)
+			defer c2.Close()
+			if res := send(c2, "a", 1); res != "" {
+				panic(fmt.Sprintf("expected no response, got '%s'", res))
+			}
+			// wait for c1 to expire
+			time.Sleep(time.Second / 2)
+			if n := atomic.LoadInt32(&closed); n != 1 {
+				panic(fmt.Sprintf("expected 1 closed session, got %d", n))
+			}
+			if res := send(c2, "a", 2); res != "opened,1" {
+				panic(fmt.Sprintf("expected 'opened,1', got '%s'", res))
+			}
+			c2.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if n := atomic.LoadInt32(&closed); n != 2 {
+		t.Fatalf("expected 2 closed sessions, got %d", n)
+	}
+}
+
+func TestUDPBatch(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPBatch("udp", ":9983")
+	})
+	t.Run("poll-sessions", func(t *testing.T) {
+		testUDPBatch("udp", ":9983", true)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPBatch("udp-net", ":9984")
+	})
+}
+
+func testUDPBatch(network, addr string, sessions ...bool) {
+	const n = 100
+	var events Events
+	events.UDPSessions = len(sessions) > 0 && sessions[0]
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("udp", addr)
+			must(err)
+			defer c.Close()
+			for i := 0; i < n; i++ {
+				_, err := c.Write([]byte(fmt.Sprintf("%d", i)))
+				must(err)
+			}
+			seen := make(map[string]bool)
+			buf := make([]byte, 64)
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			for len(seen) < n {
+				nn, err := c.Read(buf)
+				must(err)
+				seen[string(buf[:nn])] = true
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?batch=16"))
+}
+
+func TestUDPWriteTo(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testUDPWriteTo("udp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testUDPWriteTo("udp-net", ":9984")
+	})
+}
+
+func testUDPWriteTo(network, addr string) {
+	sessions := make(chan Conn, 1)
+	var events Events
+	events.UDPSessions = true
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		sessions <- c
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("udp", addr)
+			must(err)
+			defer c.Close()
+			read := func(expect string) {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			if srv.WriteTo(1, []byte("push"), c.LocalAddr()) == nil {
+				panic("expected error")
+			}
+			must(srv.WriteTo(0, []byte("push"), c.LocalAddr()))
+			read("push")
+			_, err = c.Write([]byte("hello"))
+			must(err)
+			sess := <-sessions
+			must(sess.Send([]byte("async")))
+			read("async")
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestAttach(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAttach("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAttach("tcp-net", ":9984")
+	})
+}
+
+func testAttach(network, addr string) {
+	var srv Server
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "shutdown":
+			return nil, Shutdown
+		case "detach":
+			return nil, Detach
+		}
+		return []byte(fmt.Sprintf("%v:%s", c.Context(), in)), None
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		go func() {
+			// write from blocking code and attach the connection again
+			_, err := rwc.Write([]byte("detached"))
+			must(err)
+			must(srv.Attach(rwc, 0, "again"))
+		}()
+		return
+	}
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			// attach a connection that was accepted elsewhere
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			must(err)
+			defer ln.Close()
+			c, err := net.Dial("tcp", ln.Addr().String())
+			must(err)
+			defer c.Close()
+			sc, err := ln.Accept()
+			must(err)
+			if srv.Attach(sc, 1, nil) == nil {
+				panic("expected error")
+			}
+			must(srv.Attach(sc, 0, "first"))
+			read := func(expect string) {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			_, err = c.Write([]byte("hello"))
+			must(err)
+			read("first:hello")
+			_, err = c.Write([]byte("detach"))
+			must(err)
+			read("detached")
+			_, err = c.Write([]byte("hello"))
+			must(err)
+			read("again:hello")
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestAttachInput(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testAttachInput("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testAttachInput("tcp-net", ":9984")
+	})
+}
+
+func testAttachInput(network, addr string) {
+	var srv Server
+	var events Events
+	events.MaxInputBuffer = 1024
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		ib := c.Input()
+		for {
+			i := ib.IndexByte('\n')
+			if i < 0 {
+				return out, None
+			}
+			switch line := string(ib.ReadN(i + 1)); line {
+			case "shutdown\n":
+				return out, Shutdown
+			case "detach\n":
+				// the following input is not consumed
+				return out, Detach
+			default:
+				out = append(out, fmt.Sprintf("%v:%s", c.Context(), line)...)
+			}
+		}
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		go func() {
+			must(srv.Attach(rwc, 0, "again"))
+		}()
+		return
+	}
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			_, err = c.Write([]byte("detach\nhello\n"))
+			must(err)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			must(err)
+			if string(buf[:n]) != "again:hello\n" {
+				panic(fmt.Sprintf("expected 'again:hello', got '%s'", buf[:n]))
+			}
+			c.Write([]byte("shutdown\n"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestDetachedConn(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testDetachedConn("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testDetachedConn("tcp-net", ":9984")
+	})
+}
+
+func testDetachedConn(network, addr string) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return nil, Detach
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		nc, ok := rwc.(net.Conn)
+		if !ok {
+			panic("expected a net.Conn")
+		}
+		if nc.LocalAddr().String() != c.LocalAddr().String() ||
+			nc.RemoteAddr().String() != c.RemoteAddr().String() {
+			panic(fmt.Sprintf("expected '%v %v', got '%v %v'",
+				c.LocalAddr(), c.RemoteAddr(), nc.LocalAddr(), nc.RemoteAddr()))
+		}
+		go func() {
+			defer nc.Close()
+			nc.SetReadDeadline(time.Now().Add(time.Second / 20))
+			_, err := nc.Read(make([]byte, 64))
+			if err, ok := err.(net.Error); !ok || !err.Timeout() {
+				panic(fmt.Sprintf("expected a timeout, got '%v'", err))
+			}
+			nc.SetReadDeadline(time.Time{})
+			_, err = nc.Write([]byte("timeout"))
+			must(err)
+		}()
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			_, err = c.Write([]byte("detach"))
+			must(err)
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			n, err := c.Read(buf)
+			must(err)
+			if string(buf[:n]) != "timeout" {
+				panic(fmt.Sprintf("expected 'timeout', got '%s'", buf[:n]))
+			}
+			c2, err := net.Dial("tcp", addr)
+			must(err)
+			defer c2.Close()
+			c2.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testProxyProtocol("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testProxyProtocol("tcp-net", ":9984")
+	})
+}
+
+func testProxyProtocol(network, addr string) {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		var tlvs string
+		for _, tlv := range c.ProxyHeader().TLVs {
+			tlvs += fmt.Sprintf("%d=%s", tlv.Type, tlv.Value)
+		}
+		out = []byte(fmt.Sprintf("%v %v [%s] %s",
+			c.RemoteAddr(), c.LocalAddr(), tlvs, in))
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			send := func(expect string, parts ...string) {
+				c, err := net.Dial("tcp", "127.0.0.1"+addr)
+				must(err)
+				defer c.Close()
+				for _, part := range parts {
+					_, err = c.Write([]byte(part))
+					must(err)
+					time.Sleep(time.Millisecond * 10)
+				}
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 128)
+				n, err := c.Read(buf)
+				if expect == "" {
+					if err != io.EOF {
+						panic(fmt.Sprintf("expected EOF, got '%v'", err))
+					}
+					return
+				}
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			// version 1 header in two parts
+			send("1.2.3.4:1111 5.6.7.8:2222 [] hello",
+				"PROXY TCP4 1.2.3.4 5.6.7", ".8 1111 2222\r\nhello")
+			// version 2 header with a TLV
+			v2 := "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x11" +
+				"\x0a\x00\x00\x01\x0a\x00\x00\x02\x03\xe8\x07\xd0" +
+				"\x04\x00\x02ab"
+			send("10.0.0.1:1000 10.0.0.2:2000 [4=ab] hello", v2+"hello")
+			// malformed headers
+			send("", "GET / HTTP/1.1\r\n\r\n")
+			send("", "PROXY TCP4 1.2.3.4 5.6.7.8 1111 99999\r\n")
+			if n := srv.Stats().Rejected; n != 2 {
+				panic(fmt.Sprintf("expected 2 rejected, got %d", n))
+			}
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("PROXY UNKNOWN\r\nshutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?proxyprotocol=true"))
+}
+
+func TestProxyTimeout(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testProxyTimeout("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testProxyTimeout("tcp-net", ":9984")
+	})
+}
+
+func testProxyTimeout(network, addr string) {
+	var events Events
+	events.MaxConns = 1
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			read := func(c net.Conn, expect string) {
+				c.SetReadDeadline(time.Now().Add(time.Second * 2))
+				buf := make([]byte, 128)
+				n, err := c.Read(buf)
+				if expect == "" {
+					if err != io.EOF {
+						panic(fmt.Sprintf("expected EOF, got '%v'", err))
+					}
+					return
+				}
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			// an idle client holds the only connection until it times out
+			c1, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c1.Close()
+			_, err = c1.Write([]byte("PROX"))
+			must(err)
+			time.Sleep(time.Millisecond * 50)
+			c2, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c2.Close()
+			read(c2, "")
+			read(c1, "")
+			c3, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c3.Close()
+			_, err = c3.Write([]byte("PROXY UNKNOWN\r\nhello"))
+			must(err)
+			read(c3, "hello")
+			if stats := srv.Stats(); stats.Conns != 1 || stats.Rejected != 2 {
+				panic(fmt.Sprintf("expected 1 conn and 2 rejected, got %+v",
+					stats))
+			}
+			c3.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+
+		"?proxyprotocol=true&proxytimeout=200ms"))
+}
+
+// testCertificate returns a self-signed certificate for the name.
+func testCertificate(name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	must(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	must(err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLS(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testTLS("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testTLS("tcp-net", ":9984")
+	})
+}
+
+func testTLS(network, addr string) {
+	var events Events
+	events.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{testCertificate("localhost")},
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hello\n"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "shutdown\n":
+			return nil, Shutdown
+		case "detach\n":
+			return nil, Detach
+		}
+		return in, None
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		go func() {
+			defer rwc.Close()
+			rwc.Write([]byte("detached\n"))
+		}()
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := tls.Dial("tcp", "127.0.0.1"+addr,
+				&tls.Config{InsecureSkipVerify: true})
+			must(err)
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+			rd := bufio.NewReader(c)
+			expect := func(s string) {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != s {
+					panic(fmt.Sprintf("expected '%q', got '%q'", s, line))
+				}
+			}
+			expect("hello\n")
+			_, err = c.Write([]byte("ping\n"))
+			must(err)
+			expect("ping\n")
+			// larger than a single TLS record
+			big := strings.Repeat("x", 100000) + "\n"
+			go c.Write([]byte(big))
+			var got string
+			for len(got) < len(big) {
+				line, err := rd.ReadString('\n')
+				must(err)
+				got += line
+			}
+			if got != big {
+				panic("bad output")
+			}
+			_, err = c.Write([]byte("detach\n"))
+			must(err)
+			expect("detached\n")
+			// a plaintext client fails the handshake
+			pc, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer pc.Close()
+			pc.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			ioutil.ReadAll(pc)
+			c2, err := tls.Dial("tcp", "127.0.0.1"+addr,
+				&tls.Config{InsecureSkipVerify: true})
+			must(err)
+			defer c2.Close()
+			c2.Write([]byte("shutdown\n"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?tls=true"))
+}
+
+func TestTLSTimeout(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testTLSTimeout("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testTLSTimeout("tcp-net", ":9984")
+	})
+}
+
+func testTLSTimeout(network, addr string) {
+	var events Events
+	events.MaxConns = 1
+	events.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{testCertificate("localhost")},
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			expectEOF := func(c net.Conn) {
+				c.SetReadDeadline(time.Now().Add(time.Second * 2))
+				if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+					panic(fmt.Sprintf("expected EOF, got '%v'", err))
+				}
+			}
+			// a client that never sends a ClientHello holds the only
+			// connection until the handshake times out
+			c1, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c1.Close()
+			time.Sleep(time.Millisecond * 50)
+			c2, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c2.Close()
+			expectEOF(c2)
+			expectEOF(c1)
+			c3, err := tls.Dial("tcp", "127.0.0.1"+addr,
+				&tls.Config{InsecureSkipVerify: true})
+			must(err)
+			defer c3.Close()
+			c3.SetDeadline(time.Now().Add(time.Second * 2))
+			_, err = c3.Write([]byte("hello"))
+			must(err)
+			buf := make([]byte, 16)
+			n, err := c3.Read(buf)
+			must(err)
+			if string(buf[:n]) != "hello" {
+				panic(fmt.Sprintf("expected 'hello', got '%s'", buf[:n]))
+			}
+			if stats := srv.Stats(); stats.Conns != 1 || stats.Rejected != 1 {
+				panic(fmt.Sprintf("expected 1 conn and 1 rejected, got %+v",
+					stats))
+			}
+			c3.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?tls=true&tlstimeout=200ms"))
+}
+
+func TestTLSRoutes(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testTLSRoutes("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testTLSRoutes("tcp-net", ":9984")
+	})
+}
+
+func testTLSRoutes(network, addr string) {
+	cert := testCertificate("api.test")
+	var events, echo2 Events
+	events.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{testCertificate("localhost")},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	events.TLSRoutes = []TLSRoute{
+		{ServerName: "*.test", Certificate: &cert},
+		{Protocol: "echo2", Events: &echo2},
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		state := c.TLSState()
+		return []byte(fmt.Sprintf("%s:%s:%d:%s", state.ServerName,
+			state.NegotiatedProtocol, len(state.PeerCertificates), in)), None
+	}
+	echo2.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return append([]byte("echo2:"), in...), None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			send := func(config *tls.Config, data, expect string) {
+				config.InsecureSkipVerify = true
+				c, err := tls.Dial("tcp", "127.0.0.1"+addr, config)
+				must(err)
+				defer c.Close()
+				_, err = c.Write([]byte(data))
+				must(err)
+				if expect == "" {
+					return
+				}
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+				name := c.ConnectionState().PeerCertificates[0].Subject.CommonName
+				if config.ServerName == "api.test" && name != "api.test" {
+					panic(fmt.Sprintf("expected 'api.test', got '%s'", name))
+				}
+			}
+			send(&tls.Config{ServerName: "api.test"}, "hello", "api.test::0:hello")
+			send(&tls.Config{
+				ServerName:   "localhost",
+				Certificates: []tls.Certificate{testCertificate("client")},
+			}, "hello", "localhost::1:hello")
+			send(&tls.Config{NextProtos: []string{"echo2"}}, "hello", "echo2:hello")
+			send(&tls.Config{}, "shutdown", "")
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr+"?tls=true"))
+}
+
+func TestSniffMux(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testSniffMux("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testSniffMux("tcp-net", ":9984")
+	})
+}
+
+func testSniffMux(network, addr string) {
+	handler := func(name string) Events {
+		var events Events
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			c.SetContext(name)
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			if string(in) == "*shutdown" {
+				return nil, Shutdown
+			}
+			return []byte(fmt.Sprintf("%s:%s", c.Context(), in)), None
+		}
+		return events
+	}
+	var mux SniffMux
+	mux.Handle(MatchPrefix("*"), handler("redis"))
+	mux.Handle(MatchHTTP(), handler("http"))
+	mux.Handle(MatchPrefix("\x00\x01"), handler("binary"))
+	fallback := handler("fallback")
+	mux.Fallback = &fallback
+	mux.Timeout = time.Second / 10
+	events := mux.Events()
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			send := func(expect string, parts ...string) {
+				c, err := net.Dial("tcp", "127.0.0.1"+addr)
+				must(err)
+				defer c.Close()
+				for _, part := range parts {
+					_, err = c.Write([]byte(part))
+					must(err)
+					time.Sleep(time.Millisecond * 10)
+				}
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				if string(buf[:n]) != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, buf[:n]))
+				}
+			}
+			send("redis:*1\r\n", "*1\r\n")
+			send("http:GET / HTTP/1.1\r\n", "GE", "T / HTTP/1.1\r\n")
+			send("binary:\x00\x01\x02", "\x00", "\x01\x02")
+			send("fallback:hello", "hello")
+			// undecided until the timeout
+			send("fallback:GE", "GE")
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("*shutdown"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestFrame(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testFrame("tcp", ":9983", 0)
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testFrame("tcp-net", ":9984", 0)
+	})
+	t.Run("poll-buffered", func(t *testing.T) {
+		testFrame("tcp", ":9983", 64)
+	})
+	t.Run("stdlib-buffered", func(t *testing.T) {
+		testFrame("tcp-net", ":9984", 64)
+	})
+}
+
+func testFrame(network, addr string, maxInput int) {
+	lines := codec.Line{MaxLength: 16}
+	var events Events
+	events.MaxInputBuffer = maxInput
+	events.Codec = lines
+	events.Frame = func(c Conn, frame []byte) (out []byte, action Action) {
+		if string(frame) == "shutdown" {
+			return nil, Shutdown
+		}
+		out, _ = lines.Encode(nil, append([]byte("frame:"), frame...))
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			for _, part := range []string{"a\nb", "b\r", "\nc", "cc\n"} {
+				_, err = c.Write([]byte(part))
+				must(err)
+				time.Sleep(time.Millisecond * 10)
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			rd := bufio.NewReader(c)
+			for _, expect := range []string{"a", "bb", "ccc"} {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != "frame:"+expect+"\n" {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, line))
+				}
+			}
+			// too long for the codec
+			_, err = c.Write([]byte(strings.Repeat("x", 60)))
+			must(err)
+			if _, err := rd.ReadString('\n'); err != io.EOF {
+				panic(fmt.Sprintf("expected EOF, got '%v'", err))
+			}
+			c2, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c2.Close()
+			c2.Write([]byte("shutdown\n"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
+
+func TestInputBuffer(t *testing.T) {
+	ib := &InputBuffer{max: 10000}
+	for i := 0; i < 3; i++ {
+		p := ib.space()
+		n := copy(p, "hello\nworld\n")
+		ib.commit(n)
+	}
+	if ib.Len() != 36 || ib.IndexByte('\n') != 5 ||
+		ib.Index([]byte("world")) != 6 {
+		t.Fatalf("unexpected buffer '%s'", ib.Bytes())
+	}
+	if p := ib.Peek(100); p != nil {
+		t.Fatalf("expected nil, got '%s'", p)
+	}
+	if p := ib.ReadN(6); string(p) != "hello\n" {
+		t.Fatalf("expected 'hello', got '%s'", p)
+	}
+	if n := ib.Discard(6); n != 6 || string(ib.Peek(5)) != "hello" {
+		t.Fatalf("unexpected buffer '%s'", ib.Bytes())
+	}
+	if n := ib.Discard(100); n != 24 || ib.Len() != 0 {
+		t.Fatalf("expected 24, got %d", n)
+	}
+	// the buffer doesn't grow past its limit
+	big := make([]byte, 20000)
+	if ib.write(big) || ib.Len() != 10000 || ib.space() != nil {
+		t.Fatalf("expected a full buffer, got %d bytes", ib.Len())
+	}
+	ib.Discard(9999)
+	if p := ib.space(); len(p) != 9999 {
+		t.Fatalf("expected 9999 bytes of space, got %d", len(p))
+	}
+}
+
+func TestMaxInputBuffer(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testMaxInputBuffer("tcp", ":9983")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testMaxInputBuffer("tcp-net", ":9984")
+	})
+}
+
+func testMaxInputBuffer(network, addr string) {
+	closed := make(chan error, 1)
+	var events Events
+	events.MaxInputBuffer = 64
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		ib := c.Input()
+		if ib == nil || ib.Len() != len(in) {
+			panic("expected the input buffer")
+		}
+		for {
+			i := ib.IndexByte('\n')
+			if i == -1 {
+				return
+			}
+			line := ib.ReadN(i + 1)
+			if string(line) == "shutdown\n" {
+				return nil, Shutdown
+			}
+			out = append(out, line...)
+		}
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		select {
+		case closed <- err:
+		default:
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			for _, part := range []string{"hel", "lo\nwor", "ld\n"} {
+				_, err = c.Write([]byte(part))
+				must(err)
+				time.Sleep(time.Millisecond * 10)
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			rd := bufio.NewReader(c)
+			for _, expect := range []string{"hello\n", "world\n"} {
+				line, err := rd.ReadString('\n')
+				must(err)
+				if line != expect {
+					panic(fmt.Sprintf("expected '%s', got '%s'", expect, line))
+				}
+			}
+			// over the limit without a line ending, which may reset the
+			// connection because the input is not read past the limit
+			_, err = c.Write([]byte(strings.Repeat("x", 100)))
+			must(err)
+			if _, err := rd.ReadString('\n'); err == nil {
+				panic("expected the connection to close")
+			}
+			err = <-closed
+			if lerr, ok := err.(*InputLimitError); !ok || lerr.Limit != 64 {
+				panic(fmt.Sprintf("expected an input limit error, got '%v'", err))
+			}
+			c2, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c2.Close()
+			c2.Write([]byte("shutdown\n"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+}
@@ -7,10 +7,14 @@
 package evio
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -27,12 +31,51 @@ type conn struct {
 	sa         syscall.Sockaddr // remote socket address
 	reuse      bool             // should reuse input buffer
 	opened     bool             // connection opened event fired
+	active     bool             // received data since the last rebalance
 	action     Action           // next user action
 	ctx        interface{}      // user-defined context
 	addrIndex  int              // index of listening address
 	localAddr  net.Addr         // local addre
 	remoteAddr net.Addr         // remote addr
-	loop       *loop            // connected loop
+	loop       atomic.Value     // *loop of the connection, see owner
+	ip         string           // remote ip counted by the connection limits
+	events     *Events          // events of the listener
+	udp        bool             // UDP session
+	key        udpKey           // UDP session key
+	seen       int64            // time the UDP session received a datagram
+	src        []byte           // UDP session control message for replies
+	cred       *Credentials     // unix socket peer credentials
+	unix       bool             // unix socket connection
+	packet     bool             // unixpacket connection
+	files      []*os.File       // files received with the current input
+	rights     []outRights      // files queued with the output
+	proxy      *ProxyHeader     // PROXY protocol header
+	proxyin    []byte           // PROXY protocol header read so far
+	proxying   bool             // waiting for the PROXY protocol header
+	timer      *time.Timer      // deadline of the PROXY header or TLS handshake
+	tlsc       *tls.Conn        // TLS connection
+	tlst       *tlsTransport    // memory transport under the TLS connection
+	sealed     int              // bytes of out that are TLS ciphertext
+	handshake  bool             // waiting for the TLS handshake
+	hseof      bool             // socket input ended during the handshake
+	frames     []byte           // partial frame of the Frame event
+	inbuf      *InputBuffer     // input of the MaxInputBuffer option
+}
+
+// outRights are files that are written along with the output at off. With
+// no files, it's the start of a message of a unixpacket connection.
+type outRights struct {
+	off int
+	fds []int
+}
+
+// udpKey identifies the UDP session of a remote address on a listener.
+type udpKey struct {
+	lnidx int
+	addr  [16]byte
+	port  int
+	zone  uint32
+	name  string
 }
 
 func (c *conn) Context() interface{}       { return c.ctx }
@@ -40,31 +83,178 @@ func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *conn) AddrIndex() int             { return c.addrIndex }
 func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
+func (c *conn) PeerCredentials() *Credentials {
+	return c.cred
+}
+func (c *conn) ProxyHeader() *ProxyHeader { return c.proxy }
+func (c *conn) frameBuffer() *[]byte      { return &c.frames }
+func (c *conn) Input() *InputBuffer       { return c.inbuf }
+func (c *conn) TLSState() *tls.ConnectionState {
+	if c.tlsc == nil {
+		return nil
+	}
+	state := c.tlsc.ConnectionState()
+	return &state
+}
+func (c *conn) ReceivedFiles() []*os.File {
+	files := c.files
+	c.files = nil
+	return files
+}
+func (c *conn) SendFiles(files []*os.File, payload []byte) error {
+	if !c.unix {
+		return errNotUnix
+	}
+	if len(payload) == 0 {
+		return errEmptyPayload
+	}
+	fds, err := dupFiles(files)
+	if err != nil {
+		return err
+	}
+	l := c.owner()
+	if l == nil {
+		// closed or detached
+		closeFds(fds)
+		return errClosing
+	}
+	err = l.poll.Trigger(&filesWrite{c, fds, append([]byte{}, payload...)})
+	if err != nil {
+		closeFds(fds)
+	}
+	return err
+}
+
+// filesWrite asks a loop to queue the payload and files of SendFiles.
+type filesWrite struct {
+	c   *conn
+	fds []int
+	b   []byte
+}
+
+// attachReq asks a loop to add a connected socket as a new connection.
+type attachReq struct {
+	fd    int
+	sa    syscall.Sockaddr
+	lnidx int
+	ctx   interface{}
+	in    []byte // input that was read before the socket was detached
+}
+
+// owner returns the loop of the connection. It's safe to call from any
+// goroutine, while a move may change the loop.
+func (c *conn) owner() *loop {
+	l, _ := c.loop.Load().(*loop)
+	return l
+}
+
 func (c *conn) Wake() {
-	if c.loop != nil {
-		c.loop.poll.Trigger(c)
+	if l := c.owner(); l != nil {
+		l.poll.Trigger(c)
+	}
+}
+func (c *conn) MoveTo(loopIdx int) {
+	if c.udp {
+		return // a session stays with the loop that owns its address
+	}
+	if l := c.owner(); l != nil {
+		l.poll.Trigger(&moveReq{c, loopIdx})
+	}
+}
+func (c *conn) Send(b []byte) error {
+	if !c.udp {
+		return errNotSession
 	}
+	l := c.owner()
+	if l == nil {
+		return errClosing // the session is closed
+	}
+	return l.poll.Trigger(&udpWrite{c.lnidx, append([]byte{}, b...),
+		c.sa, c.src})
+}
+
+// udpWrite asks a loop to write a datagram from a UDP listener.
+type udpWrite struct {
+	lnidx int
+	b     []byte
+	sa    syscall.Sockaddr
+	oob   []byte
+}
+
+// tlsFlush asks a loop to write the output of a TLS handshake.
+type tlsFlush struct {
+	c *conn
+}
+
+// tlsDone tells a loop that the TLS handshake of a connection is done.
+type tlsDone struct {
+	c   *conn
+	err error
+}
+
+// moveReq asks the loop that owns a connection to hand it off to the loop
+// at idx.
+type moveReq struct {
+	c   *conn
+	idx int
+}
+
+// moveIn hands a connection to its new loop.
+type moveIn struct {
+	c *conn
+}
+
+// pauseNote asks a loop to add or remove the listeners from its poll to
+// match their paused state.
+type pauseNote struct{}
+
+// rebalanceReq asks a loop to move up to n idle connections to the loop
+// at idx.
+type rebalanceReq struct {
+	idx int
+	n   int
 }
 
 type server struct {
-	events   Events             // user events
-	loops    []*loop            // all the loops
-	lns      []*listener        // all the listeners
-	wg       sync.WaitGroup     // loop close waitgroup
-	cond     *sync.Cond         // shutdown signaler
-	balance  LoadBalance        // load balancing method
-	accepted uintptr            // accept counter
-	tch      chan time.Duration // ticker channel
+	events      Events             // user events
+	loops       []*loop            // all the loops
+	lns         listenerList       // all the listeners
+	wg          sync.WaitGroup     // loop close waitgroup
+	cond        *sync.Cond         // shutdown signaler
+	balance     LoadBalance        // load balancing method
+	accepted    uintptr            // accept counter
+	tch         chan time.Duration // ticker channel
+	done        chan struct{}      // closed when the server is shutting down
+	limits      connLimits         // connection limits
+	overConns   int32              // accepting paused by PauseAcceptConns
+	overLatency int32              // accepting paused by PauseAcceptLatency
+	lnmu        sync.Mutex         // guards the started and closing states
+	started     bool               // loops are running
+	closing     bool               // server is shutting down
+	attaching   []*attachReq       // attached before the loops are running
 
 	//ticktm   time.Time      // next tick time
 }
 
 type loop struct {
-	idx     int            // loop index in the server loops list
-	poll    *internal.Poll // epoll or kqueue
-	packet  []byte         // read packet buffer
-	fdconns map[int]*conn  // loop connections fd -> conn
-	count   int32          // connection count
+	idx      int                // loop index in the server loops list
+	poll     *internal.Poll     // epoll or kqueue
+	packet   []byte             // read packet buffer
+	oob      []byte             // unix socket control message buffer
+	fdconns  map[int]*conn      // loop connections fd -> conn
+	udpconns map[udpKey]*conn   // loop UDP sessions
+	mmsg     internal.Batch     // batched UDP reads and writes
+	udpin    []internal.Message // UDP read batch
+	udpout   []internal.Message // queued UDP writes
+	udpbuf   []byte             // queued UDP write data
+	batching bool               // handling a UDP read batch
+	count    int32              // connection count
+	reserve  int                // spare fd for when the process runs out of fds
+	lnon     []bool             // listeners that are added to the poll
+	lnback   []time.Duration    // accept error backoff of the listeners
+	lnwait   []bool             // listeners that wait out their backoff
+	probed   int64              // time the pending latency probe was sent
+	latency  int64              // time it took to respond to the last probe
 }
 
 // waitForShutdown waits for a signal to shutdown
@@ -94,14 +284,24 @@ func serve(events Events, listeners []*listener) error {
 
 	s := &server{}
 	s.events = events
-	s.lns = listeners
+	setFrameData(&s.events)
+	for _, ln := range listeners {
+		if ln.events == nil {
+			ln.events = &s.events
+		}
+		s.lns.add(ln)
+	}
 	s.cond = sync.NewCond(&sync.Mutex{})
 	s.balance = events.LoadBalance
 	s.tch = make(chan time.Duration)
+	s.done = make(chan struct{})
+	s.limits.maxConns = events.MaxConns
+	s.limits.maxPerIP = events.MaxConnsPerIP
 
 	//println("-- server starting")
 	if s.events.Serving != nil {
 		var svr Server
+		svr.e = s
 		svr.NumLoops = numLoops
 		svr.Addrs = make([]net.Addr, len(listeners))
 		for i, ln := range listeners {
@@ -111,6 +311,15 @@ func serve(events Events, listeners []*listener) error {
 		switch action {
 		case None:
 		case Shutdown:
+			s.lnmu.Lock()
+			s.closing = true
+			for _, req := range s.attaching {
+				syscall.Close(req.fd)
+			}
+			s.lnmu.Unlock()
+			for _, ln := range s.lns.load() {
+				ln.close()
+			}
 			return nil
 		}
 	}
@@ -118,6 +327,10 @@ func serve(events Events, listeners []*listener) error {
 	defer func() {
 		// wait on a signal for shutdown
 		s.waitForShutdown()
+		s.lnmu.Lock()
+		s.closing = true
+		s.lnmu.Unlock()
+		close(s.done)
 
 		// notify all loops to close by closing all listeners
 		for _, l := range s.loops {
@@ -127,43 +340,426 @@ func serve(events Events, listeners []*listener) error {
 		// wait on all loops to complete reading events
 		s.wg.Wait()
 
+		// close the listeners that were added with Listen
+		for _, ln := range s.lns.load() {
+			ln.close()
+		}
+
 		// close loops and all outstanding connections
 		for _, l := range s.loops {
 			for _, c := range l.fdconns {
 				loopCloseConn(s, l, c, nil)
 			}
+			for _, c := range l.udpconns {
+				loopUDPClose(s, l, c, nil)
+			}
 			l.poll.Close()
+			if l.reserve != -1 {
+				syscall.Close(l.reserve)
+			}
 		}
 		//println("-- server stopped")
 	}()
 
 	// create loops locally and bind the listeners.
+	s.lnmu.Lock()
 	for i := 0; i < numLoops; i++ {
 		l := &loop{
-			idx:     i,
-			poll:    internal.OpenPoll(),
-			packet:  make([]byte, 0xFFFF),
-			fdconns: make(map[int]*conn),
-		}
-		for _, ln := range listeners {
-			l.poll.AddRead(ln.fd)
+			idx:      i,
+			poll:     internal.OpenPoll(),
+			packet:   make([]byte, 0xFFFF),
+			oob:      make([]byte, syscall.CmsgSpace(internal.MaxRights*4)),
+			fdconns:  make(map[int]*conn),
+			udpconns: make(map[udpKey]*conn),
+			reserve:  openReserve(),
 		}
 		s.loops = append(s.loops, l)
 	}
+	for _, l := range s.loops {
+		loopPause(s, l)
+	}
+	for _, req := range s.attaching {
+		attachLoop(s).poll.Trigger(req)
+	}
+	s.attaching = nil
+	s.started = true
+	s.lnmu.Unlock()
 	// start loops in background
 	s.wg.Add(len(s.loops))
 	for _, l := range s.loops {
 		go loopRun(s, l)
 	}
+	if s.events.Rebalance > 0 && len(s.loops) > 1 {
+		go rebalanceRun(s)
+	}
+	if s.events.PauseAcceptLatency > 0 {
+		go latencyRun(s)
+	}
+	if s.events.UDPSessions && s.events.UDPSessionTimeout > 0 {
+		go udpExpireRun(s)
+	}
+	return nil
+}
+
+func (s *server) stats() Stats {
+	return s.limits.stats()
+}
+
+func (s *server) pauseAccept(addrIndex int, paused bool) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if setFlag(&ln.paused, paused) {
+		s.lnmu.Lock()
+		if s.started && !s.closing {
+			s.notifyPause()
+		}
+		s.lnmu.Unlock()
+	}
+	return nil
+}
+
+func (s *server) listen(addr string, events *Events) (int, error) {
+	ln, _, err := listen(addr)
+	if err != nil {
+		return -1, err
+	}
+	if err := ln.system(); err != nil {
+		return -1, err
+	}
+	s.lnmu.Lock()
+	defer s.lnmu.Unlock()
+	if s.closing {
+		ln.close()
+		return -1, errClosing
+	}
+	if events != nil {
+		setFrameData(events)
+		ln.events = events
+	} else {
+		ln.events = &s.events
+	}
+	if err := checkTLS(ln, ln.events); err != nil {
+		ln.close()
+		return -1, err
+	}
+	idx := s.lns.add(ln)
+	if s.started {
+		// the loops add the new listener to their polls
+		s.notifyPause()
+	}
+	return idx, nil
+}
+
+func (s *server) attach(conn interface{}, addrIndex int, ctx interface{}) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if ln.pconn != nil {
+		return errNotStream
+	}
+	var in []byte
+	if dc, ok := conn.(*detachedConn); ok {
+		in = dc.in
+	}
+	fd, err := attachFd(conn)
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	sa, err := syscall.Getpeername(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	req := &attachReq{fd, sa, addrIndex, ctx, in}
+	s.lnmu.Lock()
+	defer s.lnmu.Unlock()
+	if s.closing {
+		syscall.Close(fd)
+		return errClosing
+	}
+	if !s.started {
+		// the loops are not running yet
+		s.attaching = append(s.attaching, req)
+		return nil
+	}
+	if err := attachLoop(s).poll.Trigger(req); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	return nil
+}
+
+// attachLoop returns the loop with the least connections.
+func attachLoop(s *server) *loop {
+	l := s.loops[0]
+	for _, ll := range s.loops[1:] {
+		if atomic.LoadInt32(&ll.count) < atomic.LoadInt32(&l.count) {
+			l = ll
+		}
+	}
+	return l
+}
+
+// attachFd returns the file descriptor of a socket that is attached to the
+// server, which takes ownership of it.
+func attachFd(conn interface{}) (int, error) {
+	switch v := conn.(type) {
+	case int:
+		return v, nil
+	case *detachedConn:
+		return attachFd(v.Conn)
+	case syscall.Conn:
+		var nfd int
+		err := sockControl(v, func(fd int) (err error) {
+			nfd, err = internal.Dup(fd)
+			return err
+		})
+		if err != nil {
+			return -1, err
+		}
+		if c, ok := v.(io.Closer); ok {
+			c.Close()
+		}
+		return nfd, nil
+	}
+	return -1, errAttach
+}
+
+// loopAttach adds an attached socket to the loop. The Opened event fires
+// once the socket is writable, as for an accepted connection, or right away
+// with the input that was read before the socket was detached.
+func loopAttach(s *server, l *loop, req *attachReq) error {
+	ln := s.lns.get(req.lnidx)
+	c := &conn{fd: req.fd, sa: req.sa, lnidx: req.lnidx,
+		events: ln.events, ctx: req.ctx}
+	c.loop.Store(l)
+	c.active = true
+	if sa, err := syscall.Getsockname(c.fd); err == nil {
+		c.localAddr = internal.SockaddrToAddr(sa)
+	}
+	s.limits.add(ln)
+	l.fdconns[c.fd] = c
+	atomic.AddInt32(&l.count, 1)
+	s.checkConns()
+	if len(req.in) > 0 {
+		l.poll.AddRead(c.fd)
+		return loopOpenIn(s, l, c, req.in)
+	}
+	l.poll.AddReadWrite(c.fd)
+	return nil
+}
+
+// loopFilesWrite queues the payload and files of SendFiles after the
+// pending output.
+func loopFilesWrite(s *server, l *loop, v *filesWrite) error {
+	if l.fdconns[v.c.fd] != v.c {
+		if v.c.owner() == nil {
+			closeFds(v.fds) // closed
+			return nil
+		}
+		return loopForward(v.c, v)
+	}
+	c := v.c
+	c.rights = append(c.rights, outRights{len(c.out), v.fds})
+	c.out = append(c.out, v.b...)
+	l.poll.ModReadWrite(c.fd)
+	return nil
+}
+
+// dupFiles duplicates the file descriptors of files.
+func dupFiles(files []*os.File) ([]int, error) {
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		err := sockControl(f, func(fd int) error {
+			nfd, err := internal.Dup(fd)
+			if err == nil {
+				fds = append(fds, nfd)
+			}
+			return err
+		})
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+	}
+	return fds, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// closeRights closes the files of a connection that were received and not
+// taken, or that were queued and not written.
+func closeRights(c *conn) {
+	closeFiles(c.files)
+	c.files = nil
+	for _, r := range c.rights {
+		closeFds(r.fds)
+	}
+	c.rights = nil
+}
+
+func (s *server) writeTo(addrIndex int, b []byte, addr net.Addr) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if ln.pconn == nil {
+		return errNotUDP
+	}
+	sa, err := udpSockaddr(ln, addr)
+	if err != nil {
+		return err
+	}
+	s.lnmu.Lock()
+	defer s.lnmu.Unlock()
+	if s.closing {
+		return errClosing
+	}
+	if atomic.LoadInt32(&ln.closed) == 1 {
+		return errListenerClosed
+	}
+	if !s.started {
+		// the loops are not running yet
+		return syscall.Sendto(ln.fd, b, 0, sa)
+	}
+	// queue the datagram on the loop that owns the sessions of the address
+	l := s.loops[addrIndex%len(s.loops)]
+	return l.poll.Trigger(&udpWrite{addrIndex, append([]byte{}, b...), sa, nil})
+}
+
+// udpSockaddr converts a remote address for writing from the UDP listener.
+func udpSockaddr(ln *listener, addr net.Addr) (syscall.Sockaddr, error) {
+	if uaddr, ok := addr.(*net.UnixAddr); ok && ln.network == "unixgram" {
+		return &syscall.SockaddrUnix{Name: uaddr.Name}, nil
+	}
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("invalid UDP address")
+	}
+	if ip4 := uaddr.IP.To4(); ip4 != nil {
+		lnaddr, _ := ln.lnaddr.(*net.UDPAddr)
+		if lnaddr == nil || lnaddr.IP.To4() != nil {
+			sa := &syscall.SockaddrInet4{Port: uaddr.Port}
+			copy(sa.Addr[:], ip4)
+			return sa, nil
+		}
+	}
+	// IPv6 listeners take IPv4 addresses in the IPv4-mapped form
+	sa := &syscall.SockaddrInet6{Port: uaddr.Port}
+	copy(sa.Addr[:], uaddr.IP.To16())
+	if uaddr.Zone != "" {
+		if ifi, err := net.InterfaceByName(uaddr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	return sa, nil
+}
+
+func (s *server) joinGroup(addrIndex int, group net.IP, iface string,
+	join bool) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	if ln.pconn == nil {
+		return errNotUDP
+	}
+	if atomic.LoadInt32(&ln.closed) == 1 {
+		return errListenerClosed
+	}
+	return joinGroup(ln.pconn, group, iface, join)
+}
+
+func (s *server) closeListener(addrIndex int) error {
+	ln := s.lns.get(addrIndex)
+	if ln == nil {
+		return errAddrIndex
+	}
+	s.lnmu.Lock()
+	defer s.lnmu.Unlock()
+	if s.closing {
+		return errClosing
+	}
+	if !setFlag(&ln.closed, true) {
+		return errListenerClosed
+	}
+	if !s.started {
+		ln.close()
+		return nil
+	}
+	// each loop removes the listener from its poll, and the last one
+	// closes it.
+	atomic.StoreInt32(&ln.refs, int32(len(s.loops)))
+	for _, l := range s.loops {
+		l.poll.Trigger(closeNote{ln})
+	}
 	return nil
 }
 
+// notifyPause tells all loops that the paused state of the listeners changed.
+func (s *server) notifyPause() {
+	for _, l := range s.loops {
+		l.poll.Trigger(pauseNote{})
+	}
+}
+
+// checkConns pauses or resumes accepting when the number of open
+// connections crosses the PauseAcceptConns threshold.
+func (s *server) checkConns() {
+	if s.events.PauseAcceptConns > 0 {
+		n := atomic.LoadInt64(&s.limits.conns)
+		if setFlag(&s.overConns, n >= int64(s.events.PauseAcceptConns)) {
+			s.notifyPause()
+		}
+	}
+}
+
 func loopCloseConn(s *server, l *loop, c *conn, err error) error {
+	if c.proxying {
+		// not yet opened
+		c.timer.Stop()
+		atomic.AddInt32(&l.count, -1)
+		delete(l.fdconns, c.fd)
+		c.loop.Store((*loop)(nil))
+		// released before the peer sees the close
+		s.limits.release(s.lns.get(c.lnidx), c.ip)
+		s.checkConns()
+		syscall.Close(c.fd)
+		return nil
+	}
 	atomic.AddInt32(&l.count, -1)
 	delete(l.fdconns, c.fd)
+	c.loop.Store((*loop)(nil))
 	syscall.Close(c.fd)
-	if s.events.Closed != nil {
-		switch s.events.Closed(c, err) {
+	closeRights(c)
+	if c.tlst != nil {
+		c.timer.Stop()
+		c.tlst.Close()
+	}
+	s.limits.release(s.lns.get(c.lnidx), c.ip)
+	s.checkConns()
+	if c.handshake {
+		return nil // not yet opened
+	}
+	if c.events.Closed != nil {
+		switch c.events.Closed(c, err) {
 		case None:
 		case Shutdown:
 			return errClosing
@@ -172,18 +768,45 @@ func loopCloseConn(s *server, l *loop, c *conn, err error) error {
 	return nil
 }
 
+// fileConn returns a net.Conn for a duplicate of the socket.
+func fileConn(fd int) (net.Conn, error) {
+	nfd, err := internal.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(nfd), "")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
 func loopDetachConn(s *server, l *loop, c *conn, err error) error {
-	if s.events.Detached == nil {
+	if c.events.Detached == nil {
 		return loopCloseConn(s, l, c, err)
 	}
+	// hand a duplicate of the socket to the Go netpoller
+	nc, ferr := fileConn(c.fd)
+	if ferr != nil {
+		return loopCloseConn(s, l, c, ferr)
+	}
 	l.poll.ModDetach(c.fd)
+	syscall.Close(c.fd)
+	closeRights(c)
+	if c.tlsc != nil {
+		// the TLS connection continues on the socket
+		c.tlst.detach(nc)
+		nc = c.tlsc
+	}
 
 	atomic.AddInt32(&l.count, -1)
 	delete(l.fdconns, c.fd)
-	if err := syscall.SetNonblock(c.fd, false); err != nil {
-		return err
+	c.loop.Store((*loop)(nil))
+	s.limits.release(s.lns.get(c.lnidx), c.ip)
+	s.checkConns()
+	var in []byte
+	if c.inbuf != nil && c.inbuf.Len() > 0 {
+		in = append([]byte{}, c.inbuf.Bytes()...)
 	}
-	switch s.events.Detached(c, &detachedConn{fd: c.fd}) {
+	switch c.events.Detached(c, &detachedConn{nc, in}) {
 	case None:
 	case Shutdown:
 		return errClosing
@@ -191,6 +814,17 @@ func loopDetachConn(s *server, l *loop, c *conn, err error) error {
 	return nil
 }
 
+// loopForward sends a note for a connection that is not on the loop to the
+// loop of the connection. The connection is moving out of or into the loop
+// when it's still its loop, and the note is then sent again until the move is
+// done. Notes for closed connections are ignored.
+func loopForward(c *conn, note interface{}) error {
+	if owner := c.owner(); owner != nil {
+		return owner.poll.Trigger(note)
+	}
+	return nil
+}
+
 func loopNote(s *server, l *loop, note interface{}) error {
 	var err error
 	switch v := note.(type) {
@@ -206,10 +840,73 @@ func loopNote(s *server, l *loop, note interface{}) error {
 		err = v
 	case *conn:
 		// Wake called for connection
+		if v.udp {
+			if l.udpconns[v.key] != v {
+				return nil // ignore wakes for closed sessions
+			}
+			return loopUDPWake(s, l, v)
+		}
 		if l.fdconns[v.fd] != v {
-			return nil // ignore stale wakes
+			return loopForward(v, v)
 		}
 		return loopWake(s, l, v)
+	case *moveReq:
+		if l.fdconns[v.c.fd] != v.c {
+			return loopForward(v.c, v)
+		}
+		return loopMoveOut(s, l, v.c, v.idx)
+	case *moveIn:
+		return loopMoveIn(s, l, v.c)
+	case *rebalanceReq:
+		return loopRebalance(s, l, v.idx, v.n)
+	case pauseNote:
+		loopPause(s, l)
+	case closeNote:
+		loopPause(s, l)
+		for _, c := range l.udpconns {
+			if s.lns.get(c.lnidx) == v.ln {
+				if err := loopUDPClose(s, l, c, nil); err != nil {
+					return err
+				}
+			}
+		}
+		if atomic.AddInt32(&v.ln.refs, -1) == 0 {
+			v.ln.close()
+		}
+	case udpExpireNote:
+		return loopUDPExpire(s, l)
+	case acceptResume:
+		l.lnwait[v.lnidx] = false
+		loopPause(s, l)
+	case *attachReq:
+		return loopAttach(s, l, v)
+	case *filesWrite:
+		return loopFilesWrite(s, l, v)
+	case *proxyExpire:
+		if l.fdconns[v.c.fd] != v.c || !v.c.proxying {
+			return nil // ignore closed and opened connections
+		}
+		s.limits.drop()
+		return loopCloseConn(s, l, v.c, nil)
+	case *tlsFlush:
+		if l.fdconns[v.c.fd] != v.c {
+			return nil // ignore closed connections
+		}
+		loopTLSFlush(l, v.c)
+	case *tlsDone:
+		if l.fdconns[v.c.fd] != v.c {
+			return nil // ignore closed connections
+		}
+		return loopTLSDone(s, l, v.c, v.err)
+	case *udpWrite:
+		if ln := s.lns.get(v.lnidx); atomic.LoadInt32(&ln.closed) == 0 {
+			loopUDPSend(l, ln, ln.fd, v.b, v.sa, v.oob)
+		}
+	case latencyProbe:
+		if sent := atomic.LoadInt64(&l.probed); sent != 0 {
+			atomic.StoreInt64(&l.latency, time.Now().UnixNano()-sent)
+			atomic.StoreInt64(&l.probed, 0)
+		}
 	}
 	return err
 }
@@ -234,6 +931,10 @@ func loopRun(s *server, l *loop) {
 		switch {
 		case c == nil:
 			return loopAccept(s, l, fd)
+		case c.proxying:
+			return loopProxyRead(s, l, c)
+		case c.handshake:
+			return loopTLSHandshake(s, l, c)
 		case !c.opened:
 			return loopOpened(s, l, c)
 		case len(c.out) > 0:
@@ -255,107 +956,725 @@ func loopTicker(s *server, l *loop) {
 	}
 }
 
+// acceptBudget is the maximum number of connections that a loop accepts from
+// a listener on a single wakeup.
+const acceptBudget = 64
+
 func loopAccept(s *server, l *loop, fd int) error {
-	for i, ln := range s.lns {
-		if ln.fd == fd {
-			if len(s.loops) > 1 {
-				switch s.balance {
-				case LeastConnections:
-					n := atomic.LoadInt32(&l.count)
-					for _, lp := range s.loops {
-						if lp.idx != l.idx {
-							if atomic.LoadInt32(&lp.count) < n {
-								return nil // do not accept
-							}
-						}
-					}
-				case RoundRobin:
-					idx := int(atomic.LoadUintptr(&s.accepted)) % len(s.loops)
-					if idx != l.idx {
-						return nil // do not accept
-					}
-					atomic.AddUintptr(&s.accepted, 1)
-				}
+	for i, ln := range s.lns.load() {
+		if ln.fd == fd && i < len(l.lnon) && l.lnon[i] {
+			if ln.pconn != nil && s.events.UDPSessions {
+				// only the loop that owns the sessions polls the address
+				return loopUDPRead(s, l, i, fd)
+			}
+			// the balancing is decided once per wakeup
+			if !loopCanAccept(s, l) {
+				return nil // do not accept
 			}
 			if ln.pconn != nil {
+				loopAccepted(s)
 				return loopUDPRead(s, l, i, fd)
 			}
-			nfd, sa, err := syscall.Accept(fd)
-			if err != nil {
-				if err == syscall.EAGAIN {
-					return nil
-				}
-				return err
-			}
-			if err := syscall.SetNonblock(nfd, true); err != nil {
-				return err
+			n, err := loopAcceptBatch(s, l, i, ln, fd)
+			if n > 0 {
+				loopAccepted(s)
 			}
-			c := &conn{fd: nfd, sa: sa, lnidx: i, loop: l}
-			c.out = nil
-			l.fdconns[c.fd] = c
-			l.poll.AddReadWrite(c.fd)
-			atomic.AddInt32(&l.count, 1)
-			break
+			return err
 		}
 	}
 	return nil
 }
 
-func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
-	n, sa, err := syscall.Recvfrom(fd, l.packet, 0)
-	if err != nil || n == 0 {
-		return nil
-	}
-	if s.events.Data != nil {
-		var sa6 syscall.SockaddrInet6
-		switch sa := sa.(type) {
-		case *syscall.SockaddrInet4:
-			sa6.ZoneId = 0
-			sa6.Port = sa.Port
-			for i := 0; i < 12; i++ {
-				sa6.Addr[i] = 0
+// loopAcceptBatch accepts up to acceptBudget connections from the listener
+// and returns the number of connections that were accepted.
+func loopAcceptBatch(s *server, l *loop, i int, ln *listener, fd int) (int, error) {
+	var n int
+	for j := 0; j < acceptBudget; j++ {
+		nfd, sa, err := internal.Accept(fd)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return n, nil
 			}
-			sa6.Addr[12] = sa.Addr[0]
-			sa6.Addr[13] = sa.Addr[1]
-			sa6.Addr[14] = sa.Addr[2]
-			sa6.Addr[15] = sa.Addr[3]
-		case *syscall.SockaddrInet6:
-			sa6 = *sa
+			if acceptRetry(err) {
+				continue
+			}
+			return n, loopAcceptError(s, l, i, fd, err)
 		}
-		c := &conn{}
-		c.addrIndex = lnidx
-		c.localAddr = s.lns[lnidx].lnaddr
-		c.remoteAddr = internal.SockaddrToAddr(&sa6)
-		in := append([]byte{}, l.packet[:n]...)
-		out, action := s.events.Data(c, in)
-		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
+		n++
+		l.lnback[i] = 0
+		c := &conn{fd: nfd, sa: sa, lnidx: i, events: ln.events}
+		c.loop.Store(l)
+		c.active = true
+		if ln.opts.proxy {
+			// counted for the peer until the header is read
+			if !loopProxyStart(s, l, c, ln) {
+				continue
 			}
-			syscall.Sendto(fd, out, 0, sa)
+			if !loopCheckConns(s, l) {
+				return n, nil // paused
+			}
+			continue
 		}
-		switch action {
-		case Shutdown:
-			return errClosing
+		if ok, err := loopAdmit(s, l, c); !ok {
+			if err != nil {
+				return n, err
+			}
+			continue
 		}
-	}
-	return nil
+		c.out = nil
+		l.fdconns[c.fd] = c
+		if ln.opts.tls {
+			l.poll.AddRead(c.fd)
+			loopTLSStart(s, l, c, nil)
+		} else {
+			l.poll.AddReadWrite(c.fd)
+		}
+		atomic.AddInt32(&l.count, 1)
+		if !loopCheckConns(s, l) {
+			return n, nil // paused
+		}
+	}
+	return n, nil
+}
+
+// loopCheckConns applies the PauseAcceptConns threshold to a connection
+// that was just accepted, and returns false if accepting is paused. The
+// listeners of the loop are paused right away, so a batch of accepts doesn't
+// go over the threshold.
+func loopCheckConns(s *server, l *loop) bool {
+	if s.checkConns(); atomic.LoadInt32(&s.overConns) == 1 {
+		loopPause(s, l)
+		return false
+	}
+	return true
+}
+
+// loopCanAccept returns true if the load balancing method allows the loop to
+// accept connections on this wakeup.
+func loopCanAccept(s *server, l *loop) bool {
+	if len(s.loops) > 1 {
+		switch s.balance {
+		case LeastConnections:
+			n := atomic.LoadInt32(&l.count)
+			for _, lp := range s.loops {
+				if lp.idx != l.idx {
+					if atomic.LoadInt32(&lp.count) < n {
+						return false
+					}
+				}
+			}
+		case RoundRobin:
+			idx := int(atomic.LoadUintptr(&s.accepted)) % len(s.loops)
+			if idx != l.idx {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// loopAccepted moves the round robin on to the next loop once a loop has
+// accepted.
+func loopAccepted(s *server) {
+	if len(s.loops) > 1 && s.balance == RoundRobin {
+		atomic.AddUintptr(&s.accepted, 1)
+	}
+}
+
+// loopAdmit applies the connection limits and the Accepting event to a newly
+// accepted connection. The connection is closed if it's rejected.
+func loopAdmit(s *server, l *loop, c *conn) (ok bool, err error) {
+	ln := s.lns.get(c.lnidx)
+	if c.remoteAddr == nil &&
+		(c.events.Accepting != nil || s.limits.maxPerIP > 0) {
+		c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	}
+	if c.proxy != nil {
+		// counted for the peer while the header was read
+		c.ip, ok = s.limits.readmit(ln, c.ip, c.remoteAddr)
+	} else {
+		c.ip, ok = s.limits.admit(ln, c.remoteAddr)
+	}
+	if ok && c.events.Accepting != nil {
+		switch c.events.Accepting(c.remoteAddr, c.lnidx) {
+		case None:
+		case Shutdown:
+			err = errClosing
+			fallthrough
+		default:
+			s.limits.reject(ln, c.ip)
+			ok = false
+		}
+	}
+	if !ok {
+		syscall.Close(c.fd)
+	}
+	return ok, err
+}
+
+// proxyExpire tells a loop that a connection did not send its PROXY protocol
+// header in time.
+type proxyExpire struct {
+	c *conn
+}
+
+// loopProxyStart counts a newly accepted connection for the address of its
+// peer and waits for its PROXY protocol header. The connection is closed if
+// it's over the limits.
+func loopProxyStart(s *server, l *loop, c *conn, ln *listener) bool {
+	var remote net.Addr
+	if s.limits.maxPerIP > 0 {
+		remote = internal.SockaddrToAddr(c.sa)
+	}
+	var ok bool
+	if c.ip, ok = s.limits.admit(ln, remote); !ok {
+		syscall.Close(c.fd)
+		return false
+	}
+	c.proxying = true
+	l.fdconns[c.fd] = c
+	l.poll.AddRead(c.fd)
+	atomic.AddInt32(&l.count, 1)
+	note := &proxyExpire{c}
+	c.timer = time.AfterFunc(ln.opts.proxyTimeout, func() {
+		if l := c.owner(); l != nil {
+			l.poll.Trigger(note)
+		}
+	})
+	return true
+}
+
+// loopProxyRead reads the PROXY protocol header of a connection and then
+// admits and opens the connection with the addresses of the header. The
+// connection is closed if the header is malformed.
+func loopProxyRead(s *server, l *loop, c *conn) error {
+	n, err := syscall.Read(c.fd, l.packet)
+	if err == syscall.EAGAIN {
+		return nil
+	}
+	var hdr *ProxyHeader
+	var hn int
+	if n > 0 && err == nil {
+		c.proxyin = append(c.proxyin, l.packet[:n]...)
+		hdr, hn, err = parseProxyHeader(c.proxyin)
+		if err == errProxyShort {
+			return nil
+		}
+	}
+	if hdr == nil {
+		s.limits.drop()
+		return loopCloseConn(s, l, c, err)
+	}
+	in := c.proxyin[hn:]
+	c.timer.Stop()
+	c.proxyin = nil
+	c.proxying = false
+	c.proxy = hdr
+	c.remoteAddr = hdr.Source
+	c.localAddr = hdr.Destination
+	if ok, err := loopAdmit(s, l, c); !ok {
+		atomic.AddInt32(&l.count, -1)
+		delete(l.fdconns, c.fd)
+		c.loop.Store((*loop)(nil))
+		s.checkConns()
+		return err
+	}
+	s.checkConns()
+	if s.lns.get(c.lnidx).opts.tls {
+		loopTLSStart(s, l, c, in)
+		return nil
+	}
+	return loopOpenIn(s, l, c, in)
+}
+
+// loopOpenIn opens a connection and delivers the input that was received
+// before it was opened, such as the data that followed a PROXY header.
+func loopOpenIn(s *server, l *loop, c *conn, in []byte) error {
+	l.poll.ModReadWrite(c.fd)
+	if err := loopOpened(s, l, c); err != nil || len(in) == 0 ||
+		c.action != None {
+		return err
+	}
+	if c.inbuf != nil {
+		if !c.inbuf.write(in) {
+			return loopCloseConn(s, l, c, &InputLimitError{c.inbuf.max})
+		}
+		in = c.inbuf.Bytes()
+	} else {
+		in = append([]byte{}, in...)
+	}
+	if c.events.Data != nil {
+		out, action := c.events.Data(c, in)
+		c.action = action
+		if len(out) > 0 {
+			queueOut(c, out)
+		}
+	}
+	if len(c.out) != 0 || c.action != None {
+		l.poll.ModReadWrite(c.fd)
+	}
+	return nil
+}
+
+// loopPause adds or removes the listeners from the loop's poll to match their
+// paused and closed state.
+func loopPause(s *server, l *loop) {
+	auto := atomic.LoadInt32(&s.overConns) == 1 ||
+		atomic.LoadInt32(&s.overLatency) == 1
+	for i, ln := range s.lns.load() {
+		if i == len(l.lnon) {
+			l.lnon = append(l.lnon, false)
+			l.lnback = append(l.lnback, 0)
+			l.lnwait = append(l.lnwait, false)
+		}
+		on := atomic.LoadInt32(&ln.closed) == 0 &&
+			atomic.LoadInt32(&ln.paused) == 0 && !(auto && ln.pconn == nil) &&
+			!l.lnwait[i]
+		if ln.pconn != nil && s.events.UDPSessions {
+			// the sessions of an address are owned by a single loop
+			on = on && i%len(s.loops) == l.idx
+		}
+		if on != l.lnon[i] {
+			if on {
+				l.poll.AddRead(ln.fd)
+			} else {
+				l.poll.ModDetach(ln.fd)
+			}
+			l.lnon[i] = on
+		}
+	}
+}
+
+// latencyRun periodically probes the loops and pauses accepting while any of
+// them takes longer than PauseAcceptLatency to respond.
+func latencyRun(s *server) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(pauseInterval):
+		}
+		var over bool
+		now := time.Now().UnixNano()
+		for _, l := range s.loops {
+			latency := atomic.LoadInt64(&l.latency)
+			if sent := atomic.LoadInt64(&l.probed); sent != 0 {
+				// the previous probe is still pending
+				latency = now - sent
+			} else {
+				atomic.StoreInt64(&l.probed, now)
+				l.poll.Trigger(latencyProbe{})
+			}
+			if time.Duration(latency) > s.events.PauseAcceptLatency {
+				over = true
+			}
+		}
+		if setFlag(&s.overLatency, over) {
+			s.notifyPause()
+		}
+	}
+}
+
+// acceptRetry returns true for accept errors that only affect the pending
+// connection, in which case the loop should move on to the next one.
+func acceptRetry(err error) bool {
+	switch err {
+	case syscall.EINTR, syscall.ECONNABORTED, syscall.ECONNRESET,
+		syscall.EPROTO, syscall.ENETDOWN, syscall.ENETUNREACH,
+		syscall.EHOSTDOWN, syscall.EHOSTUNREACH, syscall.ENOPROTOOPT,
+		syscall.EOPNOTSUPP:
+		return true
+	}
+	return false
+}
+
+// loopAcceptError handles an accept error that is not going to go away by
+// retrying. When the process is out of file descriptors the loop releases its
+// reserve descriptor to accept and immediately close the pending connection.
+// As the listener stays readable while the error persists, such as for
+// ENOBUFS or ENOMEM, the loop stops polling it for a backoff that doubles from
+// 5ms up to a second, like the stdlib backend.
+func loopAcceptError(s *server, l *loop, lnidx, fd int, err error) error {
+	if err == syscall.EMFILE || err == syscall.ENFILE {
+		if l.reserve != -1 {
+			syscall.Close(l.reserve)
+			if nfd, _, err := syscall.Accept(fd); err == nil {
+				syscall.Close(nfd)
+			}
+		}
+		l.reserve = openReserve()
+	}
+	d := l.lnback[lnidx]
+	if d == 0 {
+		d = 5 * time.Millisecond
+	} else if d *= 2; d > time.Second {
+		d = time.Second
+	}
+	l.lnback[lnidx] = d
+	l.lnwait[lnidx] = true
+	loopPause(s, l)
+	note := acceptResume{lnidx}
+	time.AfterFunc(d, func() { l.poll.Trigger(note) })
+	if s.lns.get(lnidx).events.AcceptError != nil {
+		switch s.lns.get(lnidx).events.AcceptError(lnidx, err) {
+		case None:
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// acceptResume tells a loop that the accept error backoff of a listener is
+// over.
+type acceptResume struct {
+	lnidx int
+}
+
+// openReserve opens the spare file descriptor that is released when the
+// process runs out of file descriptors.
+func openReserve() int {
+	fd, err := syscall.Open(os.DevNull, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1
+	}
+	return fd
+}
+
+func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
+	ln := s.lns.get(lnidx)
+	if ln.opts.batch > 1 || ln.opts.gro || ln.pktinfo {
+		return loopUDPReadBatch(s, l, ln, lnidx, fd)
+	}
+	n, sa, err := syscall.Recvfrom(fd, l.packet, 0)
+	if err != nil || n == 0 {
+		return nil
+	}
+	return loopUDPPacket(s, l, ln, lnidx, fd, sa, l.packet[:n], udpDst{})
+}
+
+// udpDst is the local destination of a received datagram, which is only
+// known for wildcard listeners with pktinfo.
+type udpDst struct {
+	addr net.Addr // local address, or nil for the listener address
+	oob  []byte   // control message for replying from the local address
+}
+
+// udpDstOf returns the local destination from the control message.
+func udpDstOf(ln *listener, ctl internal.UDPControl) udpDst {
+	if ctl.Dst == nil {
+		return udpDst{}
+	}
+	var port int
+	if a, ok := ln.lnaddr.(*net.UDPAddr); ok {
+		port = a.Port
+	}
+	dst := udpDst{addr: &net.UDPAddr{IP: ctl.Dst, Port: port}}
+	if ctl.Src != nil && !ctl.Src.IsMulticast() &&
+		!ctl.Src.IsUnspecified() && !ctl.Src.Equal(net.IPv4bcast) {
+		// replies can't be written from a multicast or broadcast address
+		dst.oob = internal.PktinfoOOB(ctl)
+	}
+	return dst
+}
+
+// loopUDPReadBatch reads up to the batch size of datagrams with a single
+// syscall, and writes the replies together after all the datagrams are
+// handled. Coalesced datagrams are split into their segments.
+func loopUDPReadBatch(s *server, l *loop, ln *listener, lnidx, fd int) error {
+	batch := ln.opts.batch
+	if batch < 1 {
+		batch = 1
+	}
+	for len(l.udpin) < batch {
+		l.udpin = append(l.udpin, internal.Message{
+			Buf: make([]byte, 0xFFFF),
+			OOB: make([]byte, 128),
+		})
+	}
+	n, err := l.mmsg.RecvMsgs(fd, l.udpin[:batch])
+	if err != nil {
+		return nil
+	}
+	l.batching = true
+	for i := 0; i < n && err == nil; i++ {
+		m := &l.udpin[i]
+		packet := m.Buf[:m.N]
+		var ctl internal.UDPControl
+		if m.OOBN > 0 {
+			ctl = internal.ParseUDPControl(m.OOB[:m.OOBN])
+		}
+		dst := udpDstOf(ln, ctl)
+		seg := ctl.Segment
+		if seg <= 0 {
+			seg = len(packet)
+		}
+		for len(packet) > 0 && err == nil {
+			if seg > len(packet) {
+				seg = len(packet)
+			}
+			err = loopUDPPacket(s, l, ln, lnidx, fd, m.Addr, packet[:seg], dst)
+			packet = packet[seg:]
+		}
+		m.Addr = nil
+	}
+	l.batching = false
+	loopUDPFlush(l, fd)
+	return err
+}
+
+// loopUDPFlush writes the datagrams that are queued while a batch is
+// handled.
+func loopUDPFlush(l *loop, fd int) {
+	if len(l.udpout) > 0 {
+		l.mmsg.SendMsgs(fd, l.udpout)
+		for i := range l.udpout {
+			l.udpout[i] = internal.Message{}
+		}
+		l.udpout = l.udpout[:0]
+		l.udpbuf = l.udpbuf[:0]
+	}
+}
+
+// loopUDPSend writes a datagram, or queues it while a batch is handled.
+// With the gso option, data larger than the segment size is written
+// right away as multiple datagrams, after the queued datagrams so that the
+// replies keep their order. The oob control message selects the local
+// address of the datagram.
+func loopUDPSend(l *loop, ln *listener, fd int, b []byte, sa syscall.Sockaddr,
+	oob []byte) {
+	if ln.opts.gso > 0 && len(b) > ln.opts.gso {
+		loopUDPFlush(l, fd)
+		internal.SendSegments(fd, b, ln.opts.gso, sa, oob)
+		return
+	}
+	if !l.batching {
+		internal.SendTo(fd, b, oob, sa)
+		return
+	}
+	off := len(l.udpbuf)
+	l.udpbuf = append(l.udpbuf, b...)
+	l.udpout = append(l.udpout, internal.Message{
+		Buf: l.udpbuf[off:], OOB: oob, Addr: sa,
+	})
+}
+
+// loopUDPPacket handles a datagram.
+func loopUDPPacket(s *server, l *loop, ln *listener, lnidx, fd int,
+	sa syscall.Sockaddr, packet []byte, dst udpDst) error {
+	if s.events.UDPSessions {
+		return loopUDPSession(s, l, ln, lnidx, fd, sa, packet, dst)
+	}
+	if ln.events.Data != nil {
+		var sa6 syscall.SockaddrInet6
+		raddr := syscall.Sockaddr(&sa6)
+		switch sa := sa.(type) {
+		case *syscall.SockaddrInet4:
+			sa6.ZoneId = 0
+			sa6.Port = sa.Port
+			for i := 0; i < 12; i++ {
+				sa6.Addr[i] = 0
+			}
+			sa6.Addr[12] = sa.Addr[0]
+			sa6.Addr[13] = sa.Addr[1]
+			sa6.Addr[14] = sa.Addr[2]
+			sa6.Addr[15] = sa.Addr[3]
+		case *syscall.SockaddrInet6:
+			sa6 = *sa
+		default:
+			raddr = sa
+		}
+		c := &conn{events: ln.events}
+		c.addrIndex = lnidx
+		c.localAddr = ln.lnaddr
+		if dst.addr != nil {
+			c.localAddr = dst.addr
+		}
+		c.remoteAddr = internal.SockaddrToUDPAddr(raddr)
+		in := append([]byte{}, packet...)
+		out, action := c.events.Data(c, in)
+		if len(out) > 0 {
+			if c.events.PreWrite != nil {
+				c.events.PreWrite()
+			}
+			loopUDPSend(l, ln, fd, out, sa, dst.oob)
+		}
+		switch action {
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// loopUDPSession handles a datagram for the session of the remote address,
+// and opens the session on the first datagram.
+func loopUDPSession(s *server, l *loop, ln *listener, lnidx, fd int,
+	sa syscall.Sockaddr, packet []byte, dst udpDst) error {
+	key := udpKeyOf(lnidx, sa)
+	c := l.udpconns[key]
+	if c == nil {
+		max := s.events.UDPMaxSessions
+		if max > 0 && atomic.LoadInt64(&ln.sessions) >= int64(max) {
+			return nil // session table is full, drop the datagram
+		}
+		c = &conn{fd: fd, sa: sa, lnidx: lnidx, events: ln.events}
+		c.loop.Store(l)
+		c.udp = true
+		c.key = key
+		c.opened = true
+		c.addrIndex = lnidx
+		c.localAddr = ln.lnaddr
+		if dst.addr != nil {
+			c.localAddr = dst.addr
+		}
+		c.remoteAddr = internal.SockaddrToUDPAddr(sa)
+		c.src = dst.oob
+		l.udpconns[key] = c
+		atomic.AddInt64(&ln.sessions, 1)
+		if c.events.Opened != nil {
+			out, _, action := c.events.Opened(c)
+			if err := loopUDPAction(s, l, c, out, action); err != nil {
+				return err
+			}
+			if l.udpconns[key] != c {
+				return nil // closed by the Opened event
+			}
+		}
+	}
+	c.seen = time.Now().UnixNano()
+	if c.events.Data != nil {
+		in := append([]byte{}, packet...)
+		out, action := c.events.Data(c, in)
+		return loopUDPAction(s, l, c, out, action)
+	}
+	return nil
+}
+
+// udpKeyOf returns the session key of a remote address.
+func udpKeyOf(lnidx int, sa syscall.Sockaddr) udpKey {
+	key := udpKey{lnidx: lnidx}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		key.addr[10], key.addr[11] = 0xff, 0xff
+		copy(key.addr[12:], sa.Addr[:])
+		key.port = sa.Port
+	case *syscall.SockaddrInet6:
+		key.addr = sa.Addr
+		key.port = sa.Port
+		key.zone = sa.ZoneId
+	case *syscall.SockaddrUnix:
+		key.name = sa.Name
+	}
+	return key
+}
+
+// loopUDPAction sends the output of an event to the remote address of the
+// session and applies the action.
+func loopUDPAction(s *server, l *loop, c *conn, out []byte, action Action) error {
+	if len(out) > 0 {
+		if c.events.PreWrite != nil {
+			c.events.PreWrite()
+		}
+		loopUDPSend(l, s.lns.get(c.lnidx), c.fd, out, c.sa, c.src)
+	}
+	switch action {
+	case Shutdown:
+		return errClosing
+	case Close, Detach:
+		return loopUDPClose(s, l, c, nil)
+	}
+	return nil
+}
+
+func loopUDPWake(s *server, l *loop, c *conn) error {
+	if c.events.Data == nil {
+		return nil
+	}
+	out, action := c.events.Data(c, nil)
+	return loopUDPAction(s, l, c, out, action)
+}
+
+func loopUDPClose(s *server, l *loop, c *conn, err error) error {
+	delete(l.udpconns, c.key)
+	c.loop.Store((*loop)(nil))
+	atomic.AddInt64(&s.lns.get(c.lnidx).sessions, -1)
+	if c.events.Closed != nil {
+		switch c.events.Closed(c, err) {
+		case None:
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+// loopUDPExpire closes the sessions that have been idle for longer than
+// UDPSessionTimeout.
+func loopUDPExpire(s *server, l *loop) error {
+	idle := time.Now().UnixNano() - int64(s.events.UDPSessionTimeout)
+	for _, c := range l.udpconns {
+		if c.seen < idle {
+			if err := loopUDPClose(s, l, c, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// udpExpireRun periodically asks the loops to close the expired UDP
+// sessions.
+func udpExpireRun(s *server) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(udpExpireInterval(s.events.UDPSessionTimeout)):
+		}
+		for _, l := range s.loops {
+			l.poll.Trigger(udpExpireNote{})
+		}
+	}
+}
+
+// loopLocalAddr returns the local address of an accepted connection, which
+// differs from the listener address when listening on a wildcard address.
+func loopLocalAddr(ln *listener, fd int) net.Addr {
+	if a, ok := ln.lnaddr.(*net.TCPAddr); ok && a.IP.IsUnspecified() {
+		if sa, err := syscall.Getsockname(fd); err == nil {
+			if addr := internal.SockaddrToAddr(sa); addr != nil {
+				return addr
+			}
+		}
+	}
+	return ln.lnaddr
 }
 
 func loopOpened(s *server, l *loop, c *conn) error {
 	c.opened = true
 	c.addrIndex = c.lnidx
-	c.localAddr = s.lns[c.lnidx].lnaddr
-	c.remoteAddr = internal.SockaddrToAddr(c.sa)
-	if s.events.Opened != nil {
-		out, opts, action := s.events.Opened(c)
+	if c.localAddr == nil {
+		c.localAddr = loopLocalAddr(s.lns.get(c.lnidx), c.fd)
+	}
+	if c.remoteAddr == nil {
+		c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	}
+	if _, ok := c.sa.(*syscall.SockaddrUnix); ok {
+		c.unix = true
+		c.packet = s.lns.get(c.lnidx).network == "unixpacket"
+		c.cred = peerCredentials(c.fd)
+	}
+	c.inbuf = newInputBuffer(c.events)
+	if c.events.Opened != nil {
+		out, opts, action := c.events.Opened(c)
 		if len(out) > 0 {
-			c.out = append([]byte{}, out...)
+			queueOut(c, out)
 		}
 		c.action = action
 		c.reuse = opts.ReuseInputBuffer
 		if opts.TCPKeepAlive > 0 {
-			if _, ok := s.lns[c.lnidx].ln.(*net.TCPListener); ok {
+			if _, ok := s.lns.get(c.lnidx).ln.(*net.TCPListener); ok {
 				internal.SetKeepAlive(c.fd, int(opts.TCPKeepAlive/time.Second))
 			}
 		}
@@ -367,16 +1686,30 @@ func loopOpened(s *server, l *loop, c *conn) error {
 }
 
 func loopWrite(s *server, l *loop, c *conn) error {
-	if s.events.PreWrite != nil {
-		s.events.PreWrite()
+	if c.events.PreWrite != nil {
+		c.events.PreWrite()
+	}
+	if c.tlsc != nil && c.sealed < len(c.out) {
+		if err := loopTLSSeal(c); err != nil {
+			return loopCloseConn(s, l, c, err)
+		}
+	}
+	var n int
+	var err error
+	if len(c.rights) > 0 {
+		n, err = loopWriteRights(c)
+	} else {
+		n, err = syscall.Write(c.fd, c.out)
 	}
-	n, err := syscall.Write(c.fd, c.out)
 	if err != nil {
 		if err == syscall.EAGAIN {
 			return nil
 		}
 		return loopCloseConn(s, l, c, err)
 	}
+	if c.tlsc != nil {
+		c.sealed -= n
+	}
 	if n == len(c.out) {
 		// release the connection output page if it goes over page size,
 		// otherwise keep reusing existing page.
@@ -394,6 +1727,48 @@ func loopWrite(s *server, l *loop, c *conn) error {
 	return nil
 }
 
+// loopWriteRights writes the output up to the next queued files, or writes
+// the files along with the output that follows them.
+func loopWriteRights(c *conn) (n int, err error) {
+	r := c.rights[0]
+	if r.off > 0 {
+		n, err = syscall.Write(c.fd, c.out[:r.off])
+	} else {
+		out := c.out
+		if len(c.rights) > 1 {
+			out = out[:c.rights[1].off]
+		}
+		if len(r.fds) == 0 {
+			n, err = syscall.Write(c.fd, out)
+		} else {
+			n, err = internal.WriteRights(c.fd, out, r.fds)
+		}
+		if err == nil {
+			closeFds(r.fds)
+			c.rights = c.rights[1:]
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	for i := range c.rights {
+		c.rights[i].off -= n
+	}
+	if len(c.rights) == 0 {
+		c.rights = nil
+	}
+	return n, nil
+}
+
+// queueOut appends output to a connection. The output of a unixpacket
+// connection is written as its own message.
+func queueOut(c *conn, out []byte) {
+	if c.packet && c.tlsc == nil && len(c.out) > 0 {
+		c.rights = append(c.rights, outRights{off: len(c.out)})
+	}
+	c.out = append(c.out, out...)
+}
+
 func loopAction(s *server, l *loop, c *conn) error {
 	switch c.action {
 	default:
@@ -412,13 +1787,13 @@ func loopAction(s *server, l *loop, c *conn) error {
 }
 
 func loopWake(s *server, l *loop, c *conn) error {
-	if s.events.Data == nil {
+	if c.events.Data == nil {
 		return nil
 	}
-	out, action := s.events.Data(c, nil)
+	out, action := c.events.Data(c, nil)
 	c.action = action
 	if len(out) > 0 {
-		c.out = append([]byte{}, out...)
+		queueOut(c, out)
 	}
 	if len(c.out) != 0 || c.action != None {
 		l.poll.ModReadWrite(c.fd)
@@ -428,87 +1803,300 @@ func loopWake(s *server, l *loop, c *conn) error {
 
 func loopRead(s *server, l *loop, c *conn) error {
 	var in []byte
-	n, err := syscall.Read(c.fd, l.packet)
+	var n int
+	var err error
+	// plaintext input is read directly into the input buffer, except for the
+	// messages of a unixpacket connection, which a short read would truncate
+	direct := c.inbuf != nil && c.tlsc == nil && !c.packet
+	packet := l.packet
+	if direct {
+		if packet = c.inbuf.space(); packet == nil {
+			return loopCloseConn(s, l, c, &InputLimitError{c.inbuf.max})
+		}
+	}
+	if c.unix {
+		var fds []int
+		n, fds, err = internal.ReadRights(c.fd, packet, l.oob)
+		for _, fd := range fds {
+			c.files = append(c.files, os.NewFile(uintptr(fd), ""))
+		}
+	} else {
+		n, err = syscall.Read(c.fd, packet)
+	}
 	if n == 0 || err != nil {
 		if err == syscall.EAGAIN {
 			return nil
 		}
 		return loopCloseConn(s, l, c, err)
 	}
-	in = l.packet[:n]
-	if !c.reuse {
+	c.active = true
+	in = packet[:n]
+	if direct {
+		c.inbuf.commit(n)
+		in = c.inbuf.Bytes()
+	} else if c.tlsc != nil {
+		c.tlst.feed(in)
+		if in, err = loopTLSRead(l, c); err != nil && len(in) == 0 {
+			if err == io.EOF {
+				err = nil
+			}
+			return loopCloseConn(s, l, c, err)
+		}
+		if loopTLSFlush(l, c); len(in) == 0 {
+			return nil // incomplete record
+		}
+		if c.inbuf != nil {
+			if !c.inbuf.write(in) {
+				return loopCloseConn(s, l, c, &InputLimitError{c.inbuf.max})
+			}
+			in = c.inbuf.Bytes()
+		}
+	} else if c.inbuf != nil {
+		if !c.inbuf.write(in) {
+			return loopCloseConn(s, l, c, &InputLimitError{c.inbuf.max})
+		}
+		in = c.inbuf.Bytes()
+	} else if !c.reuse {
 		in = append([]byte{}, in...)
 	}
-	if s.events.Data != nil {
-		out, action := s.events.Data(c, in)
+	if c.events.Data != nil {
+		out, action := c.events.Data(c, in)
 		c.action = action
 		if len(out) > 0 {
-			c.out = append(c.out[:0], out...)
+			queueOut(c, out)
 		}
 	}
+	if err != nil && c.action == None {
+		// the TLS connection was closed after the input
+		c.action = Close
+	}
+	if c.files != nil {
+		closeFiles(c.files)
+		c.files = nil
+	}
 	if len(c.out) != 0 || c.action != None {
 		l.poll.ModReadWrite(c.fd)
 	}
 	return nil
 }
 
-type detachedConn struct {
-	fd int
+// loopTLSStart starts the TLS handshake of a connection. The in is the
+// ciphertext that was already read, such as after a PROXY header.
+func loopTLSStart(s *server, l *loop, c *conn, in []byte) {
+	ln := s.lns.get(c.lnidx)
+	if c.remoteAddr == nil {
+		c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	}
+	if c.localAddr == nil {
+		c.localAddr = loopLocalAddr(ln, c.fd)
+	}
+	c.tlst = newTLSTransport(c.localAddr, c.remoteAddr, in, func() {
+		l.poll.Trigger(&tlsFlush{c})
+	})
+	c.tlsc = tls.Server(c.tlst, ln.tlsConfig())
+	c.handshake = true
+	// the handshake fails and the connection is closed when it expires
+	c.timer = time.AfterFunc(ln.opts.tlsTimeout, c.tlst.expire)
+	go func(tc *tls.Conn) {
+		err := tc.Handshake()
+		l.poll.Trigger(&tlsDone{c, err})
+	}(c.tlsc)
 }
 
-func (c *detachedConn) Close() error {
-	err := syscall.Close(c.fd)
-	if err != nil {
-		return err
+// loopTLSHandshake moves the ciphertext of a TLS handshake between the
+// socket and the handshake goroutine.
+func loopTLSHandshake(s *server, l *loop, c *conn) error {
+	n, err := syscall.Read(c.fd, l.packet)
+	if err != syscall.EAGAIN {
+		if err != nil {
+			return loopCloseConn(s, l, c, err)
+		}
+		if n == 0 {
+			// let the handshake and the input that came with it finish
+			// before closing
+			l.poll.ModDetach(c.fd)
+			c.hseof = true
+			c.tlst.end()
+			return nil
+		}
+		c.tlst.feed(l.packet[:n])
+	}
+	if len(c.out) > 0 {
+		n, err := syscall.Write(c.fd, c.out)
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return nil
+			}
+			return loopCloseConn(s, l, c, err)
+		}
+		c.out = c.out[n:]
+		c.sealed -= n
+		if len(c.out) == 0 {
+			l.poll.ModRead(c.fd)
+		}
 	}
-	c.fd = -1
 	return nil
 }
 
-func (c *detachedConn) Read(p []byte) (n int, err error) {
-	n, err = syscall.Read(c.fd, p)
+// loopTLSDone opens the connection once its TLS handshake is done.
+func loopTLSDone(s *server, l *loop, c *conn, err error) error {
+	c.timer.Stop()
 	if err != nil {
-		return n, err
+		return loopCloseConn(s, l, c, nil)
+	}
+	c.tlst.unblock()
+	c.events = s.lns.get(c.lnidx).tlsEvents(c.tlsc.ConnectionState())
+	if c.hseof {
+		c.hseof = false
+		l.poll.AddReadWrite(c.fd)
+	}
+	loopTLSFlush(l, c)
+	// the data that arrived with the end of the handshake
+	in, rerr := loopTLSRead(l, c)
+	if rerr != nil && len(in) == 0 {
+		return loopCloseConn(s, l, c, nil)
 	}
-	if n == 0 {
-		if len(p) == 0 {
-			return 0, nil
+	c.handshake = false
+	if err := loopOpenIn(s, l, c, in); err != nil {
+		return err
+	}
+	if rerr != nil && c.action == None {
+		// the TLS connection was closed after the input
+		c.action = Close
+		l.poll.ModReadWrite(c.fd)
+	}
+	return nil
+}
+
+// loopTLSFlush queues the ciphertext that the TLS connection has written,
+// ahead of the output that is not yet encrypted.
+func loopTLSFlush(l *loop, c *conn) {
+	if out := c.tlst.take(); len(out) > 0 {
+		c.out = append(c.out[:c.sealed], append(out, c.out[c.sealed:]...)...)
+		c.sealed += len(out)
+		if !c.hseof {
+			l.poll.ModReadWrite(c.fd)
 		}
-		return 0, io.EOF
 	}
-	return n, nil
 }
 
-func (c *detachedConn) Write(p []byte) (n int, err error) {
-	n = len(p)
-	for len(p) > 0 {
-		nn, err := syscall.Write(c.fd, p)
+// loopTLSSeal encrypts the output that is not yet encrypted.
+func loopTLSSeal(c *conn) error {
+	plain := c.out[c.sealed:]
+	c.out = c.out[:c.sealed]
+	if _, err := c.tlsc.Write(plain); err != nil {
+		return err
+	}
+	c.out = append(c.out, c.tlst.take()...)
+	c.sealed = len(c.out)
+	return nil
+}
+
+// loopTLSRead returns the plaintext of the ciphertext that was fed to the
+// TLS connection.
+func loopTLSRead(l *loop, c *conn) ([]byte, error) {
+	var in []byte
+	for {
+		n, err := c.tlsc.Read(l.packet)
+		in = append(in, l.packet[:n]...)
 		if err != nil {
-			return n, err
+			if err == errWouldBlock {
+				err = nil
+			}
+			return in, err
 		}
-		p = p[nn:]
 	}
-	return n, nil
 }
 
-func (ln *listener) close() {
-	if ln.fd != 0 {
-		syscall.Close(ln.fd)
-	}
-	if ln.f != nil {
-		ln.f.Close()
+// loopMoveOut removes the connection from the loop and hands it off to the
+// loop at idx.
+func loopMoveOut(s *server, l *loop, c *conn, idx int) error {
+	if idx < 0 || idx >= len(s.loops) || idx == l.idx {
+		return nil
 	}
-	if ln.ln != nil {
-		ln.ln.Close()
+	l.poll.ModDetach(c.fd)
+	atomic.AddInt32(&l.count, -1)
+	delete(l.fdconns, c.fd)
+	c.loop.Store(s.loops[idx])
+	return s.loops[idx].poll.Trigger(&moveIn{c})
+}
+
+// loopMoveIn adds a connection that was moved from another loop.
+func loopMoveIn(s *server, l *loop, c *conn) error {
+	l.fdconns[c.fd] = c
+	atomic.AddInt32(&l.count, 1)
+	if len(c.out) != 0 || c.action != None {
+		l.poll.AddReadWrite(c.fd)
+	} else {
+		l.poll.AddRead(c.fd)
 	}
-	if ln.pconn != nil {
-		ln.pconn.Close()
+	return nil
+}
+
+// loopRebalance moves up to n idle connections to the loop at idx and
+// resets the activity of the remaining connections.
+func loopRebalance(s *server, l *loop, idx, n int) error {
+	for _, c := range l.fdconns {
+		if n > 0 && c.opened && !c.active && len(c.out) == 0 &&
+			c.action == None {
+			if err := loopMoveOut(s, l, c, idx); err != nil {
+				return err
+			}
+			n--
+		}
+		c.active = false
 	}
-	if ln.network == "unix" {
-		os.RemoveAll(ln.addr)
+	return nil
+}
+
+// rebalanceInterval is the delay between rebalance checks.
+var rebalanceInterval = time.Second
+
+// rebalanceRun periodically compares the connection counts of all loops and
+// asks the busiest loop to move idle connections to the least busy loop.
+func rebalanceRun(s *server) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(rebalanceInterval):
+		}
+		min, max := s.loops[0], s.loops[0]
+		for _, l := range s.loops[1:] {
+			if atomic.LoadInt32(&l.count) < atomic.LoadInt32(&min.count) {
+				min = l
+			}
+			if atomic.LoadInt32(&l.count) > atomic.LoadInt32(&max.count) {
+				max = l
+			}
+		}
+		diff := int(atomic.LoadInt32(&max.count) - atomic.LoadInt32(&min.count))
+		if diff > s.events.Rebalance {
+			max.poll.Trigger(&rebalanceReq{idx: min.idx, n: diff / 2})
+		}
 	}
 }
 
+func (ln *listener) close() {
+	ln.once.Do(func() {
+		if ln.fd != 0 {
+			syscall.Close(ln.fd)
+		}
+		if ln.f != nil {
+			ln.f.Close()
+		}
+		if ln.ln != nil {
+			ln.ln.Close()
+		}
+		if ln.pconn != nil {
+			ln.pconn.Close()
+		}
+		if strings.HasPrefix(ln.network, "unix") && !isAbstract(ln.addr) {
+			os.RemoveAll(ln.addr)
+		}
+	})
+}
+
 // system takes the net listener and detaches it from it's parent
 // event loop, grabs the file descriptor, and makes it non-blocking.
 func (ln *listener) system() error {
@@ -518,6 +2106,8 @@ func (ln *listener) system() error {
 		switch pconn := ln.pconn.(type) {
 		case *net.UDPConn:
 			ln.f, err = pconn.File()
+		case *net.UnixConn:
+			ln.f, err = pconn.File()
 		}
 	case *net.TCPListener:
 		ln.f, err = netln.File()
@@ -529,7 +2119,22 @@ func (ln *listener) system() error {
 		return err
 	}
 	ln.fd = int(ln.f.Fd())
-	return syscall.SetNonblock(ln.fd, true)
+	if err := syscall.SetNonblock(ln.fd, true); err != nil {
+		ln.close()
+		return err
+	}
+	if ln.pconn != nil && ln.opts.gro {
+		if err := internal.SetUDPGRO(ln.fd); err != nil {
+			ln.close()
+			return err
+		}
+	}
+	if a, ok := ln.lnaddr.(*net.UDPAddr); ok && a.IP.IsUnspecified() {
+		// the local address of each datagram is only known with pktinfo,
+		// which is not available on all platforms.
+		ln.pktinfo = internal.SetPktinfo(ln.fd, a.IP.To4() == nil) == nil
+	}
+	return nil
 }
 
 func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
@@ -539,3 +2144,176 @@ func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
 func reuseportListen(proto, addr string) (l net.Listener, err error) {
 	return reuseport.Listen(proto, addr)
 }
+
+// umaskMu serializes the changes to the umask of the process.
+var umaskMu sync.Mutex
+
+// restrictUmask adds the mask to the umask of the process, so that files are
+// created without its permissions, and returns the previous umask. The
+// returned function restores the umask. Other goroutines only ever see a
+// stricter umask in the meantime.
+func restrictUmask(mask int) (old int, restore func()) {
+	umaskMu.Lock()
+	old = syscall.Umask(0777)
+	syscall.Umask(old | mask)
+	return old, func() {
+		syscall.Umask(old)
+		umaskMu.Unlock()
+	}
+}
+
+// listenMulticast listens on the port of a multicast address and joins its
+// group. The socket is bound to the wildcard address, so that other groups
+// can be joined with JoinGroup.
+func listenMulticast(network, addr string, opts addrOpts) (net.PacketConn, error) {
+	gaddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ipv6 := gaddr.IP.To4() == nil
+	network = "udp4"
+	if ipv6 {
+		network = "udp6"
+	}
+	var lc net.ListenConfig
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+				syscall.SO_REUSEADDR, 1)
+		})
+		return err
+	}
+	laddr := &net.UDPAddr{Port: gaddr.Port}
+	pconn, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	err = sockControl(pconn, func(fd int) error {
+		if opts.loop != nil {
+			err := internal.SetMulticastLoop(fd, ipv6, *opts.loop)
+			if err != nil {
+				return err
+			}
+		}
+		if opts.ttl > 0 {
+			if err := internal.SetMulticastTTL(fd, ipv6, opts.ttl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = joinGroup(pconn, gaddr.IP, opts.iface, true)
+	}
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+	return pconn, nil
+}
+
+// joinGroup joins or leaves a multicast group on the interface.
+func joinGroup(pconn net.PacketConn, group net.IP, iface string, join bool) error {
+	if group == nil || !group.IsMulticast() {
+		return errors.New("invalid multicast group")
+	}
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return err
+		}
+	}
+	return sockControl(pconn, func(fd int) error {
+		return internal.JoinGroup(fd, group, ifi, join)
+	})
+}
+
+// sockControl calls fn with the file descriptor of the connection.
+func sockControl(conn interface{}, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("socket options are not available")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// peerCredentials returns the credentials of the process on the other end
+// of a unix socket connection.
+func peerCredentials(fd int) *Credentials {
+	pid, uid, gid, err := internal.PeerCredentials(fd)
+	if err != nil {
+		return nil
+	}
+	return &Credentials{PID: pid, UID: uid, GID: gid}
+}
+
+// connPeerCredentials returns the peer credentials of a stdlib unix socket
+// connection.
+func connPeerCredentials(conn net.Conn) *Credentials {
+	var cred *Credentials
+	sockControl(conn, func(fd int) error {
+		cred = peerCredentials(fd)
+		return nil
+	})
+	return cred
+}
+
+// maxRightsSpace is the size of the control message buffer for reading
+// passed files.
+var maxRightsSpace = syscall.CmsgSpace(internal.MaxRights * 4)
+
+// connRead reads from a stdlib connection, and returns the files that are
+// passed along with the data over a unix socket.
+func connRead(conn net.Conn, p, oob []byte) (n int, files []*os.File, err error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok || oob == nil {
+		n, err = conn.Read(p)
+		return n, nil, err
+	}
+	n, oobn, _, _, err := uc.ReadMsgUnix(p, oob)
+	if oobn > 0 {
+		msgs, perr := syscall.ParseSocketControlMessage(oob[:oobn])
+		if perr == nil {
+			for i := range msgs {
+				fds, perr := syscall.ParseUnixRights(&msgs[i])
+				if perr != nil {
+					continue
+				}
+				for _, fd := range fds {
+					syscall.CloseOnExec(fd)
+					files = append(files, os.NewFile(uintptr(fd), ""))
+				}
+			}
+		}
+	}
+	if err == nil && n == 0 {
+		err = io.EOF
+	}
+	return n, files, err
+}
+
+// connSendFiles writes the payload with the files passed along over a
+// stdlib unix socket connection.
+func connSendFiles(conn net.Conn, files []*os.File, payload []byte) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errNotUnix
+	}
+	fds, err := dupFiles(files)
+	if err != nil {
+		return err
+	}
+	defer closeFds(fds)
+	_, _, err = uc.WriteMsgUnix(payload, syscall.UnixRights(fds...), nil)
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import "github.com/tidwall/evio/codec"
+
+// framedConn is a connection that keeps the partial frame of the Frame
+// event.
+type framedConn interface {
+	frameBuffer() *[]byte
+}
+
+// setFrameData sets the Data event of events that have a Frame event and a
+// Codec to one that splits the input into frames.
+func setFrameData(events *Events) {
+	if events.Frame == nil || events.Codec == nil {
+		return
+	}
+	frame, codec := events.Frame, events.Codec
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fc, ok := c.(framedConn)
+		if in == nil || !ok {
+			// woken up
+			return frame(c, in)
+		}
+		if ib := c.Input(); ib != nil {
+			// the frames are decoded from the input buffer in place
+			return decodeFrames(c, ib, codec, frame)
+		}
+		buf := fc.frameBuffer()
+		data := in
+		if len(*buf) > 0 {
+			*buf = append(*buf, in...)
+			data = *buf
+		}
+		for len(data) > 0 && action == None {
+			f, n, err := codec.Decode(data)
+			if err != nil {
+				*buf = nil
+				return out, Close
+			}
+			if n == 0 {
+				break
+			}
+			data = data[n:]
+			fout, faction := frame(c, f)
+			out = append(out, fout...)
+			action = faction
+		}
+		if len(data) == 0 {
+			if cap(*buf) > 0xFFFF {
+				*buf = nil
+			} else {
+				*buf = (*buf)[:0]
+			}
+		} else if len(data) != len(*buf) {
+			*buf = append((*buf)[:0], data...)
+		}
+		return out, action
+	}
+}
+
+// decodeFrames fires the Frame event for the complete frames of an input
+// buffer and discards them.
+func decodeFrames(c Conn, ib *InputBuffer, codec codec.Decoder,
+	frame func(c Conn, frame []byte) ([]byte, Action)) (out []byte,
+	action Action) {
+	for ib.Len() > 0 && action == None {
+		f, n, err := codec.Decode(ib.Bytes())
+		if err != nil {
+			return out, Close
+		}
+		if n == 0 {
+			break
+		}
+		fout, faction := frame(c, f)
+		ib.Discard(n)
+		out = append(out, fout...)
+		action = faction
+	}
+	return out, action
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package http is an HTTP/1.1 server that runs on the evio loops. Requests
+// are parsed incrementally from the input of the connections, pipelined
+// requests are served in order, and the responses are written through the
+// loop.
+//
+//	srv := &http.Server{Handler: http.HandlerFunc(
+//		func(w *http.ResponseWriter, r *http.Request) {
+//			w.Header().Set("Content-Type", "text/plain")
+//			w.WriteString("Hello World!\r\n")
+//		})}
+//	events := srv.Events()
+//	events.NumLoops = -1
+//	evio.Serve(events, "tcp://:8080")
+package http
+
+import (
+	"net/textproto"
+
+	"github.com/tidwall/evio"
+)
+
+// Header is the header fields of a request or response, keyed by their
+// canonical names.
+type Header map[string][]string
+
+// Get returns the first value of the key, or "".
+func (h Header) Get(key string) string {
+	return textproto.MIMEHeader(h).Get(key)
+}
+
+// Values returns all the values of the key.
+func (h Header) Values(key string) []string {
+	return textproto.MIMEHeader(h).Values(key)
+}
+
+// Set replaces the values of the key with the value.
+func (h Header) Set(key, value string) {
+	textproto.MIMEHeader(h).Set(key, value)
+}
+
+// Add adds the value to the key.
+func (h Header) Add(key, value string) {
+	textproto.MIMEHeader(h).Add(key, value)
+}
+
+// Del deletes the values of the key.
+func (h Header) Del(key string) {
+	textproto.MIMEHeader(h).Del(key)
+}
+
+// Request is an HTTP request. A Request is only valid during the call to
+// the Handler.
+type Request struct {
+	Method     string // such as "GET"
+	Target     string // request target as sent, such as "/search?q=evio"
+	Path       string // path of the target, which is not unescaped
+	Query      string // query of the target without the "?"
+	Proto      string // "HTTP/1.1" or "HTTP/1.0"
+	ProtoMinor int    // 1 or 0
+	Host       string // value of the Host header
+	Header     Header
+	// ContentLength is the length of the body, or -1 for a chunked body.
+	ContentLength int64
+	// Body is the whole body of the request, which may share memory with
+	// the input of the connection.
+	Body []byte
+	// Trailer is the trailer fields of a chunked body, or nil.
+	Trailer Header
+	// Close is true if the connection closes after the response.
+	Close bool
+	// Conn is the connection of the request.
+	Conn evio.Conn
+
+	chunked   bool // the body is chunked
+	keepAlive bool // an HTTP/1.0 connection is kept alive
+}
+
+// Handler serves HTTP requests.
+type Handler interface {
+	// ServeHTTP writes the response to the request. The response is
+	// complete when ServeHTTP returns.
+	ServeHTTP(w *ResponseWriter, r *Request)
+}
+
+// HandlerFunc is a function that serves HTTP requests.
+type HandlerFunc func(w *ResponseWriter, r *Request)
+
+// ServeHTTP calls f(w, r).
+func (f HandlerFunc) ServeHTTP(w *ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Server serves HTTP/1.1 on evio connections.
+type Server struct {
+	// Handler serves the requests. Setting to nil responds to all requests
+	// with 404 Not Found.
+	Handler Handler
+	// MaxHeaderBytes is the maximum size of the request line and the header
+	// fields of a request. Larger requests are answered with 431 Request
+	// Header Fields Too Large. Setting to 0 means 1 MB.
+	MaxHeaderBytes int
+	// MaxBodyBytes is the maximum size of the body of a request, which is
+	// buffered before the request is served. Larger requests are answered
+	// with 413 Request Entity Too Large. Setting to 0 means 4 MB.
+	MaxBodyBytes int
+}
+
+// httpConn is the context of a connection.
+type httpConn struct {
+	p  parser
+	w  ResponseWriter
+	is evio.InputStream // input without an evio.InputBuffer
+}
+
+// Events returns the events that serve HTTP. The other events and options,
+// such as Serving and NumLoops, can be set on the returned value. The
+// server uses the context of the connections.
+func (s *Server) Events() evio.Events {
+	maxHeader, maxBody := s.MaxHeaderBytes, s.MaxBodyBytes
+	if maxHeader <= 0 {
+		maxHeader = 1 << 20
+	}
+	if maxBody <= 0 {
+		maxBody = 4 << 20
+	}
+	var events evio.Events
+	// the input never holds more than a head, a body, and a chunk size line
+	events.MaxInputBuffer = maxHeader + maxBody + maxChunkLine
+	events.Opened = func(c evio.Conn) (out []byte, opts evio.Options,
+		action evio.Action) {
+		hc := &httpConn{}
+		hc.p.maxHeader, hc.p.maxBody = maxHeader, maxBody
+		c.SetContext(hc)
+		return
+	}
+	events.Data = func(c evio.Conn, in []byte) (out []byte,
+		action evio.Action) {
+		hc, ok := c.Context().(*httpConn)
+		if !ok {
+			return nil, evio.Close
+		}
+		if ib := c.Input(); ib != nil {
+			var n int
+			out, n, action = s.serve(c, hc, ib.Bytes())
+			ib.Discard(n)
+			return out, action
+		}
+		data := hc.is.Begin(in)
+		out, n, action := s.serve(c, hc, data)
+		hc.is.End(data[n:])
+		return out, action
+	}
+	return events
+}
+
+// serve serves the complete requests in data and returns the responses and
+// the number of bytes that were used.
+func (s *Server) serve(c evio.Conn, hc *httpConn, data []byte) (out []byte,
+	n int, action evio.Action) {
+	p := &hc.p
+	for {
+		m, done, err := p.parse(data[n:])
+		n += m
+		if err != nil {
+			serr, _ := err.(*statusError)
+			return appendError(out, serr.status, serr.msg), n, evio.Close
+		}
+		if !done {
+			if p.expect && !p.continued && p.phase != phaseHead {
+				out = append(out, "HTTP/1.1 100 Continue\r\n\r\n"...)
+				p.continued = true
+			}
+			return out, n, evio.None
+		}
+		req := &p.req
+		req.Conn = c
+		w := &hc.w
+		w.reset(req, out)
+		if s.Handler != nil {
+			s.Handler.ServeHTTP(w, req)
+		} else {
+			w.WriteHeader(404)
+			w.WriteString("404 page not found\n")
+		}
+		out = w.finish()
+		close := w.close
+		w.reset(nil, nil)
+		p.reset()
+		if close {
+			return out, n, evio.Close
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	stdhttp "net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/evio"
+)
+
+// parseAll parses the requests in data and returns them as strings.
+func parseAll(p *parser, data []byte) (reqs []string, rest []byte, err error) {
+	for {
+		n, done, err := p.parse(data)
+		data = data[n:]
+		if err != nil || !done {
+			return reqs, data, err
+		}
+		r := &p.req
+		reqs = append(reqs, fmt.Sprintf("%s %s %s %q %q %v %v", r.Method,
+			r.Path, r.Query, r.Body, r.Trailer.Get("X-Sum"), r.Close,
+			p.expect))
+		p.reset()
+	}
+}
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		input string
+		reqs  []string
+	}{
+		{"GET /a?b=1 HTTP/1.1\r\nHost: x\r\n\r\n",
+			[]string{`GET /a b=1 "" "" false false`}},
+		{"\r\nGET / HTTP/1.0\n\nGET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n",
+			[]string{`GET /  "" "" true false`, `GET /  "" "" false false`}},
+		{"POST /p HTTP/1.1\r\nHost: x\r\ncontent-length: 5\r\n\r\nhello" +
+			"GET http://x/y?z HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n",
+			[]string{`POST /p  "hello" "" false false`,
+				`GET /y z "" "" true false`}},
+		{"PUT / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n" +
+			"Expect: 100-continue\r\n\r\n" +
+			"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 11\r\n\r\n",
+			[]string{`PUT /  "hello world" "11" false true`}},
+	}
+	for i, test := range tests {
+		// every split of the input parses the same requests
+		for j := 0; j <= len(test.input); j++ {
+			p := &parser{maxHeader: 1024, maxBody: 1024}
+			reqs, rest, err := parseAll(p, []byte(test.input[:j]))
+			if err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+			more, rest, err := parseAll(p,
+				append(append([]byte{}, rest...), test.input[j:]...))
+			if err != nil {
+				t.Fatalf("test %d: %v", i, err)
+			}
+			reqs = append(reqs, more...)
+			if len(rest) != 0 || fmt.Sprint(reqs) != fmt.Sprint(test.reqs) {
+				t.Fatalf("test %d: expected %q, got %q", i, test.reqs, reqs)
+			}
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	tests := []struct {
+		input  string
+		status int
+	}{
+		{"GET /\r\n\r\n", 400},
+		{"GET / HTTP/2.0\r\nHost: x\r\n\r\n", 505},
+		{"GET / HTTP/1.1\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: x\r\nBad Name: 1\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: x\r\nA: 1\r\n folded\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("A: 1\r\n", 200), 431},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 2000\r\n\r\n", 413},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\n" +
+			"Content-Length: 2\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -1\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n", 501},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"zz\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"801\r\n", 413},
+		{"POST / HTTP/1.1\r\nHost: x\r\nExpect: magic\r\n\r\n", 417},
+	}
+	for i, test := range tests {
+		p := &parser{maxHeader: 1024, maxBody: 1024}
+		_, _, err := parseAll(p, []byte(test.input))
+		serr, ok := err.(*statusError)
+		if !ok || serr.status != test.status {
+			t.Fatalf("test %d: expected %d, got '%v'", i, test.status, err)
+		}
+	}
+}
+
+func TestResponseHeader(t *testing.T) {
+	var w ResponseWriter
+	w.reset(&Request{Method: "GET", ProtoMinor: 1}, nil)
+	w.Header().Set("X-Value", "a\r\nSet-Cookie: evil=1")
+	w.Header()["Bad Key"] = []string{"x"}
+	w.Header()["X-Bad\r\nSet-Cookie"] = []string{"evil=2"}
+	w.WriteString("body")
+	out := w.finish()
+	res, err := stdhttp.ReadResponse(bufio.NewReader(bytes.NewReader(out)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Header.Get("X-Value"); v != "a  Set-Cookie: evil=1" {
+		t.Fatalf("expected the value on one line, got '%s'", v)
+	}
+	if v := res.Header.Get("Set-Cookie"); v != "" {
+		t.Fatalf("expected no Set-Cookie, got '%s'", v)
+	}
+	if bytes.Contains(out, []byte("Bad Key")) {
+		t.Fatalf("expected the invalid field name to be dropped:\n%s", out)
+	}
+}
+
+func TestServer(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		testServer("tcp", ":9971")
+	})
+	t.Run("stdlib", func(t *testing.T) {
+		testServer("tcp-net", ":9972")
+	})
+}
+
+func testServer(network, addr string) {
+	var shutdown int32
+	srv := &Server{MaxBodyBytes: 1024}
+	srv.Handler = HandlerFunc(func(w *ResponseWriter, r *Request) {
+		switch r.Path {
+		case "/hello":
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteString("hello " + r.Query)
+		case "/echo":
+			w.Header().Set("X-Sum", r.Trailer.Get("X-Sum"))
+			w.Write(r.Body)
+		case "/stream":
+			w.WriteString("hello ")
+			w.Flush()
+			w.WriteString("stream")
+		case "/shutdown":
+			atomic.StoreInt32(&shutdown, 1)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	events := srv.Events()
+	events.Tick = func() (delay time.Duration, action evio.Action) {
+		if atomic.LoadInt32(&shutdown) == 1 {
+			action = evio.Shutdown
+		}
+		return time.Millisecond * 10, action
+	}
+	events.Serving = func(_ evio.Server) (action evio.Action) {
+		go func() {
+			c, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			rd := bufio.NewReader(c)
+			expect := func(method, status, body, header string) {
+				res, err := stdhttp.ReadResponse(rd,
+					&stdhttp.Request{Method: method})
+				must(err)
+				b, err := ioutil.ReadAll(res.Body)
+				must(err)
+				res.Body.Close()
+				if res.Status != status || string(b) != body ||
+					(header != "" && res.Header.Get("X-Sum") != header) {
+					panic(fmt.Sprintf("expected '%s %s', got '%s %s'",
+						status, body, res.Status, b))
+				}
+			}
+			// pipelined requests, written in small pieces
+			pipeline := "GET /hello?world HTTP/1.1\r\nHost: x\r\n\r\n" +
+				"POST /echo HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nping" +
+				"HEAD /hello HTTP/1.1\r\nHost: x\r\n\r\n" +
+				"HEAD /stream HTTP/1.1\r\nHost: x\r\n\r\n" +
+				"GET /stream HTTP/1.1\r\nHost: x\r\n\r\n" +
+				"GET /missing HTTP/1.1\r\nHost: x\r\n\r\n"
+			for i := 0; i < len(pipeline); i += 20 {
+				end := i + 20
+				if end > len(pipeline) {
+					end = len(pipeline)
+				}
+				_, err := c.Write([]byte(pipeline[i:end]))
+				must(err)
+				time.Sleep(time.Millisecond)
+			}
+			expect("GET", "200 OK", "hello world", "")
+			expect("POST", "200 OK", "ping", "")
+			expect("HEAD", "200 OK", "", "")
+			expect("HEAD", "200 OK", "", "")
+			expect("GET", "200 OK", "hello stream", "")
+			expect("GET", "404 Not Found", "", "")
+			// a chunked body after 100 Continue
+			_, err = c.Write([]byte("POST /echo HTTP/1.1\r\nHost: x\r\n" +
+				"Transfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n"))
+			must(err)
+			line, err := rd.ReadString('\n')
+			must(err)
+			if line != "HTTP/1.1 100 Continue\r\n" {
+				panic(fmt.Sprintf("expected 100 Continue, got '%s'", line))
+			}
+			_, err = rd.ReadString('\n')
+			must(err)
+			_, err = c.Write([]byte("4\r\npong\r\n0\r\nX-Sum: 4\r\n\r\n"))
+			must(err)
+			expect("POST", "200 OK", "pong", "4")
+			// too large, which closes the connection
+			_, err = c.Write([]byte("POST /echo HTTP/1.1\r\nHost: x\r\n" +
+				"Content-Length: 2000\r\n\r\n"))
+			must(err)
+			expect("POST", "413 Request Entity Too Large",
+				"request body too large\n", "")
+			if _, err := rd.ReadByte(); err != io.EOF {
+				panic(fmt.Sprintf("expected EOF, got '%v'", err))
+			}
+			// Connection: close
+			c2, err := net.Dial("tcp", "127.0.0.1"+addr)
+			must(err)
+			defer c2.Close()
+			c2.SetReadDeadline(time.Now().Add(time.Second * 5))
+			_, err = c2.Write([]byte("GET /shutdown HTTP/1.1\r\nHost: x\r\n" +
+				"Connection: close\r\n\r\n"))
+			must(err)
+			rd = bufio.NewReader(c2)
+			expect("GET", "200 OK", "", "")
+			if _, err := rd.ReadByte(); err != io.EOF {
+				panic(fmt.Sprintf("expected EOF, got '%v'", err))
+			}
+		}()
+		return
+	}
+	must(evio.Serve(events, network+"://"+addr))
+}
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	stdhttp "net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// statusError is a request that can't be served. The connection is closed
+// after the response with the status.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+func badRequest(msg string) error {
+	return &statusError{stdhttp.StatusBadRequest, msg}
+}
+
+// maxChunkLine is the maximum length of the size line of a chunk, which
+// includes the chunk extensions.
+const maxChunkLine = 4096
+
+type phase int
+
+const (
+	phaseHead      phase = iota // request line and headers
+	phaseBody                   // body with a Content-Length
+	phaseChunkSize              // size line of a chunk
+	phaseChunkData              // data of a chunk
+	phaseChunkEnd               // line ending after the data of a chunk
+	phaseTrailer                // trailer fields after the last chunk
+)
+
+// parser is an incremental HTTP/1.1 request parser. The bytes that it has
+// used are consumed as they arrive, except for a body with a Content-Length,
+// which is kept in the input until the request is served, so it's not
+// copied.
+type parser struct {
+	maxHeader int
+	maxBody   int
+	phase     phase
+	scanned   int    // bytes of the head that were scanned for its end
+	remain    int    // bytes left of the body or the chunk
+	trailer   int    // bytes of the trailer fields so far
+	chunks    []byte // body that was decoded from the chunks
+	expect    bool   // the client waits for 100 Continue
+	continued bool   // 100 Continue was sent
+	req       Request
+}
+
+// parse parses the request at the start of data and returns the number of
+// bytes that it used, and true once the request is complete. The Body of a
+// complete request may share memory with data.
+func (p *parser) parse(data []byte) (n int, done bool, err error) {
+	for {
+		switch p.phase {
+		case phaseHead:
+			if p.scanned == 0 {
+				// empty lines before the request line are ignored
+				n = skipEmptyLines(data)
+			}
+			m, err := p.parseHead(data[n:])
+			if err != nil || m == 0 {
+				return n, false, err
+			}
+			n += m
+			switch {
+			case p.req.chunked:
+				p.phase = phaseChunkSize
+			case p.req.ContentLength > 0:
+				p.phase = phaseBody
+				p.remain = int(p.req.ContentLength)
+			default:
+				return n, true, nil
+			}
+		case phaseBody:
+			if len(data)-n < p.remain {
+				return n, false, nil
+			}
+			p.req.Body = data[n : n+p.remain]
+			return n + p.remain, true, nil
+		case phaseChunkSize:
+			i := bytes.IndexByte(data[n:], '\n')
+			if i == -1 {
+				if len(data)-n > maxChunkLine {
+					return n, false, badRequest("chunk size line too long")
+				}
+				return n, false, nil
+			}
+			size, err := parseChunkSize(trimCR(data[n : n+i]))
+			if err != nil {
+				return n, false, err
+			}
+			if size > int64(p.maxBody-len(p.chunks)) {
+				return n, false, &statusError{stdhttp.StatusRequestEntityTooLarge,
+					"request body too large"}
+			}
+			n += i + 1
+			if size == 0 {
+				p.phase = phaseTrailer
+			} else {
+				p.phase = phaseChunkData
+				p.remain = int(size)
+			}
+		case phaseChunkData:
+			m := len(data) - n
+			if m > p.remain {
+				m = p.remain
+			}
+			p.chunks = append(p.chunks, data[n:n+m]...)
+			n += m
+			if p.remain -= m; p.remain > 0 {
+				return n, false, nil
+			}
+			p.phase = phaseChunkEnd
+		case phaseChunkEnd:
+			switch {
+			case len(data)-n >= 1 && data[n] == '\n':
+				n++
+			case len(data)-n >= 2 && data[n] == '\r' && data[n+1] == '\n':
+				n += 2
+			case len(data)-n == 0 || (len(data)-n == 1 && data[n] == '\r'):
+				return n, false, nil
+			default:
+				return n, false, badRequest("malformed chunk")
+			}
+			p.phase = phaseChunkSize
+		case phaseTrailer:
+			i := bytes.IndexByte(data[n:], '\n')
+			if i == -1 {
+				if p.trailer+len(data)-n > p.maxHeader {
+					return n, false, &statusError{
+						stdhttp.StatusRequestHeaderFieldsTooLarge, "trailer too large"}
+				}
+				return n, false, nil
+			}
+			line := trimCR(data[n : n+i])
+			n += i + 1
+			if len(line) == 0 {
+				p.req.Body = p.chunks
+				return n, true, nil
+			}
+			if p.trailer += i + 1; p.trailer > p.maxHeader {
+				return n, false, &statusError{
+					stdhttp.StatusRequestHeaderFieldsTooLarge, "trailer too large"}
+			}
+			key, value, err := parseField(line)
+			if err != nil {
+				return n, false, err
+			}
+			if p.req.Trailer == nil {
+				p.req.Trailer = make(Header)
+			}
+			p.req.Trailer.Add(key, value)
+		}
+	}
+}
+
+// reset prepares the parser for the next request.
+func (p *parser) reset() {
+	if cap(p.chunks) > 0xFFFF {
+		p.chunks = nil
+	} else {
+		p.chunks = p.chunks[:0]
+	}
+	*p = parser{maxHeader: p.maxHeader, maxBody: p.maxBody, chunks: p.chunks}
+}
+
+// parseHead parses the request line and the header fields once they are
+// complete, and returns the number of bytes that they used.
+func (p *parser) parseHead(data []byte) (int, error) {
+	var end int
+	for end == 0 {
+		i := bytes.IndexByte(data[p.scanned:], '\n')
+		if i == -1 {
+			if len(data) > p.maxHeader {
+				return 0, &statusError{stdhttp.StatusRequestHeaderFieldsTooLarge,
+					"request header too large"}
+			}
+			return 0, nil
+		}
+		line := trimCR(data[p.scanned : p.scanned+i])
+		p.scanned += i + 1
+		if p.scanned > p.maxHeader {
+			return 0, &statusError{stdhttp.StatusRequestHeaderFieldsTooLarge,
+				"request header too large"}
+		}
+		if len(line) == 0 {
+			end = p.scanned
+		}
+	}
+	head := data[:end]
+	i := bytes.IndexByte(head, '\n')
+	if err := p.parseRequestLine(trimCR(head[:i])); err != nil {
+		return 0, err
+	}
+	req := &p.req
+	req.Header = make(Header)
+	for head = head[i+1:]; ; {
+		i := bytes.IndexByte(head, '\n')
+		line := trimCR(head[:i])
+		head = head[i+1:]
+		if len(line) == 0 {
+			break
+		}
+		key, value, err := parseField(line)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Add(key, value)
+	}
+	return end, p.checkHeader()
+}
+
+// parseRequestLine parses the method, target, and version of a request.
+func (p *parser) parseRequestLine(line []byte) error {
+	req := &p.req
+	i := bytes.IndexByte(line, ' ')
+	j := bytes.LastIndexByte(line, ' ')
+	if i <= 0 || j <= i+1 {
+		return badRequest("malformed request line")
+	}
+	method, target, proto := line[:i], line[i+1:j], line[j+1:]
+	if !isToken(method) {
+		return badRequest("malformed method")
+	}
+	for _, c := range target {
+		if c <= ' ' || c == 0x7F {
+			return badRequest("malformed request target")
+		}
+	}
+	switch string(proto) {
+	case "HTTP/1.1":
+		req.ProtoMinor = 1
+	case "HTTP/1.0":
+		req.ProtoMinor = 0
+	default:
+		if bytes.HasPrefix(proto, []byte("HTTP/")) {
+			return &statusError{stdhttp.StatusHTTPVersionNotSupported,
+				"unsupported HTTP version"}
+		}
+		return badRequest("malformed HTTP version")
+	}
+	req.Method = methodString(method)
+	req.Target = string(target)
+	req.Proto = string(proto)
+	req.Path, req.Query = splitTarget(req.Target)
+	return nil
+}
+
+// checkHeader applies the header fields that frame the request and control
+// the connection.
+func (p *parser) checkHeader() error {
+	req := &p.req
+	h := req.Header
+	if hosts := h["Host"]; len(hosts) > 1 ||
+		(len(hosts) == 0 && req.ProtoMinor == 1) {
+		return badRequest("missing or repeated Host header")
+	} else if len(hosts) == 1 {
+		req.Host = hosts[0]
+	}
+	te, cl := h["Transfer-Encoding"], h["Content-Length"]
+	switch {
+	case len(te) > 0:
+		if len(cl) > 0 || req.ProtoMinor == 0 {
+			return badRequest("unexpected Transfer-Encoding")
+		}
+		if len(te) > 1 || !strings.EqualFold(te[0], "chunked") {
+			return &statusError{stdhttp.StatusNotImplemented,
+				"unsupported Transfer-Encoding"}
+		}
+		req.chunked = true
+		req.ContentLength = -1
+	case len(cl) > 0:
+		for _, v := range cl {
+			if v != cl[0] {
+				return badRequest("conflicting Content-Length")
+			}
+		}
+		n, err := strconv.ParseUint(cl[0], 10, 63)
+		if err != nil || cl[0][0] == '+' {
+			return badRequest("malformed Content-Length")
+		}
+		if n > uint64(p.maxBody) {
+			return &statusError{stdhttp.StatusRequestEntityTooLarge,
+				"request body too large"}
+		}
+		req.ContentLength = int64(n)
+	}
+	close := hasToken(h["Connection"], "close")
+	keepAlive := hasToken(h["Connection"], "keep-alive")
+	// HTTP/1.0 connections close unless they ask to be kept alive
+	req.keepAlive = req.ProtoMinor == 0 && keepAlive && !close
+	req.Close = close || (req.ProtoMinor == 0 && !keepAlive)
+	if expect := h.Get("Expect"); expect != "" {
+		if !strings.EqualFold(expect, "100-continue") {
+			return &statusError{stdhttp.StatusExpectationFailed,
+				"unsupported Expect header"}
+		}
+		p.expect = req.ProtoMinor == 1 &&
+			(req.chunked || req.ContentLength > 0)
+	}
+	return nil
+}
+
+// parseField parses a header or trailer field line.
+func parseField(line []byte) (key, value string, err error) {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 || !isToken(line[:i]) {
+		// also rejects line folding and whitespace before the colon
+		return "", "", badRequest("malformed header field")
+	}
+	v := bytes.Trim(line[i+1:], " \t")
+	for _, c := range v {
+		if (c < ' ' && c != '\t') || c == 0x7F {
+			return "", "", badRequest("malformed header value")
+		}
+	}
+	return textproto.CanonicalMIMEHeaderKey(string(line[:i])), string(v), nil
+}
+
+// parseChunkSize parses the hexadecimal size of a chunk, ignoring the chunk
+// extensions.
+func parseChunkSize(line []byte) (int64, error) {
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	line = bytes.TrimRight(line, " \t")
+	if len(line) == 0 || len(line) > 15 {
+		return 0, badRequest("malformed chunk size")
+	}
+	var size int64
+	for _, c := range line {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, badRequest("malformed chunk size")
+		}
+		size = size<<4 | int64(c)
+	}
+	return size, nil
+}
+
+// splitTarget returns the path and query of a request target in the origin
+// form, such as "/search?q=evio", or the absolute form.
+func splitTarget(target string) (path, query string) {
+	if !strings.HasPrefix(target, "/") {
+		i := strings.Index(target, "://")
+		if i == -1 {
+			return "", "" // authority or asterisk form
+		}
+		target = target[i+3:]
+		if i = strings.IndexAny(target, "/?"); i == -1 {
+			return "/", ""
+		}
+		target = target[i:]
+		if target[0] == '?' {
+			target = "/" + target
+		}
+	}
+	if i := strings.IndexByte(target, '?'); i != -1 {
+		return target[:i], target[i+1:]
+	}
+	return target, ""
+}
+
+// skipEmptyLines returns the number of bytes of the empty lines at the start
+// of data.
+func skipEmptyLines(data []byte) (n int) {
+	for {
+		switch {
+		case len(data)-n >= 1 && data[n] == '\n':
+			n++
+		case len(data)-n >= 2 && data[n] == '\r' && data[n+1] == '\n':
+			n += 2
+		default:
+			return n
+		}
+	}
+}
+
+func trimCR(line []byte) []byte {
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1]
+	}
+	return line
+}
+
+// isToken returns true if b is a token, such as a method or a field name.
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c <= ' ' || c >= 0x7F ||
+			strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// methodString returns the method without allocating for the common
+// methods.
+func methodString(b []byte) string {
+	for _, m := range [...]string{"GET", "POST", "HEAD", "PUT", "DELETE",
+		"OPTIONS", "PATCH", "CONNECT", "TRACE"} {
+		if string(b) == m {
+			return m
+		}
+	}
+	return string(b)
+}
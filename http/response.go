@@ -0,0 +1,241 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"errors"
+	stdhttp "net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBodyNotAllowed is returned by the writes of a response whose status,
+// such as 204 No Content or 304 Not Modified, has no body.
+var ErrBodyNotAllowed = errors.New("http: response status has no body")
+
+// TimeFormat is the format of the Date header.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// ResponseWriter writes the response to a request into the output of the
+// connection. The body is buffered, and the response is written with a
+// Content-Length once the handler returns, unless the handler calls Flush.
+type ResponseWriter struct {
+	req     *Request
+	header  Header
+	status  int
+	body    []byte // body that is not yet written
+	out     []byte // output of the connection
+	flushed bool   // the header was written
+	chunked bool   // the body is written in chunks
+	close   bool   // the connection closes after the response
+}
+
+// Header returns the header fields of the response, which can be changed
+// until the header is written. Fields with an invalid name are not written,
+// and a CR or LF in a value is written as a space.
+func (w *ResponseWriter) Header() Header {
+	if w.header == nil {
+		w.header = make(Header)
+	}
+	return w.header
+}
+
+// WriteHeader sets the status code of the response. The default is 200 OK.
+// Only the first call has an effect.
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && !w.flushed {
+		w.status = status
+	}
+}
+
+// Write adds the data to the body of the response.
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if !bodyAllowed(w.statusCode()) {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.flushed {
+		w.writeBody(p)
+	} else {
+		w.body = append(w.body, p...)
+	}
+	return len(p), nil
+}
+
+// WriteString adds the string to the body of the response.
+func (w *ResponseWriter) WriteString(s string) (int, error) {
+	if !bodyAllowed(w.statusCode()) {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.flushed {
+		w.writeBody([]byte(s))
+	} else {
+		w.body = append(w.body, s...)
+	}
+	return len(s), nil
+}
+
+// Flush writes the header and the buffered body to the output of the
+// connection, and the following writes go straight to the output. Unless
+// the handler has set a Content-Length, the body of an HTTP/1.1 response is
+// then chunked, and an HTTP/1.0 connection is closed after the response.
+func (w *ResponseWriter) Flush() {
+	if !w.flushed {
+		w.writeHead(-1)
+	}
+	w.writeBody(w.body)
+	w.body = w.body[:0]
+}
+
+func (w *ResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return stdhttp.StatusOK
+	}
+	return w.status
+}
+
+// reset prepares the writer for the response to the request, which is
+// appended to out.
+func (w *ResponseWriter) reset(req *Request, out []byte) {
+	for key := range w.header {
+		delete(w.header, key)
+	}
+	body := w.body[:0]
+	if cap(body) > 0xFFFF {
+		body = nil
+	}
+	*w = ResponseWriter{req: req, header: w.header, body: body, out: out}
+}
+
+// finish completes the response and returns the output of the connection.
+func (w *ResponseWriter) finish() []byte {
+	if !w.flushed {
+		w.writeHead(len(w.body))
+		w.writeBody(w.body)
+	} else if w.chunked {
+		w.out = append(w.out, "0\r\n\r\n"...)
+	}
+	return w.out
+}
+
+// writeHead writes the status line and the header fields. The length is the
+// length of the body, or -1 if it's not known.
+func (w *ResponseWriter) writeHead(length int) {
+	w.flushed = true
+	status := w.statusCode()
+	h := w.Header()
+	w.close = w.req.Close || hasToken(h["Connection"], "close")
+	h.Del("Transfer-Encoding")
+	switch {
+	case !bodyAllowed(status):
+		h.Del("Content-Length")
+	case length >= 0:
+		h.Set("Content-Length", strconv.Itoa(length))
+	case len(h["Content-Length"]) > 0:
+	case w.req.Method == "HEAD":
+		// the response has no body to frame
+	case w.req.ProtoMinor == 1:
+		w.chunked = true
+		h.Set("Transfer-Encoding", "chunked")
+	default:
+		// the end of the body is the end of the connection
+		w.close = true
+	}
+	switch {
+	case w.close:
+		h.Set("Connection", "close")
+	case w.req.keepAlive:
+		h.Set("Connection", "keep-alive")
+	}
+	if _, ok := h["Date"]; !ok {
+		h.Set("Date", time.Now().UTC().Format(TimeFormat))
+	}
+	w.out = appendStatusLine(w.out, status)
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !isToken([]byte(key)) {
+			continue // an invalid field name is dropped, like net/http
+		}
+		for _, value := range h[key] {
+			w.out = append(w.out, key...)
+			w.out = append(w.out, ": "...)
+			w.out = appendHeaderValue(w.out, value)
+			w.out = append(w.out, '\r', '\n')
+		}
+	}
+	w.out = append(w.out, '\r', '\n')
+}
+
+// appendHeaderValue appends a header value with its CR and LF bytes replaced
+// by spaces, so that the value can't start another header line.
+func appendHeaderValue(b []byte, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\r' || c == '\n' {
+			c = ' '
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// writeBody writes body data to the output of the connection.
+func (w *ResponseWriter) writeBody(p []byte) {
+	if len(p) == 0 || w.req.Method == "HEAD" {
+		return
+	}
+	if w.chunked {
+		w.out = strconv.AppendInt(w.out, int64(len(p)), 16)
+		w.out = append(w.out, '\r', '\n')
+		w.out = append(w.out, p...)
+		w.out = append(w.out, '\r', '\n')
+		return
+	}
+	w.out = append(w.out, p...)
+}
+
+// appendError appends the response to a request that can't be served.
+func appendError(out []byte, status int, msg string) []byte {
+	out = appendStatusLine(out, status)
+	out = append(out, "Connection: close\r\n"...)
+	out = append(out, "Content-Type: text/plain; charset=utf-8\r\n"...)
+	out = append(out, "Content-Length: "...)
+	out = strconv.AppendInt(out, int64(len(msg)+1), 10)
+	out = append(out, "\r\nDate: "...)
+	out = time.Now().UTC().AppendFormat(out, TimeFormat)
+	out = append(out, "\r\n\r\n"...)
+	out = append(out, msg...)
+	return append(out, '\n')
+}
+
+func appendStatusLine(out []byte, status int) []byte {
+	out = append(out, "HTTP/1.1 "...)
+	out = strconv.AppendInt(out, int64(status), 10)
+	out = append(out, ' ')
+	out = append(out, stdhttp.StatusText(status)...)
+	return append(out, '\r', '\n')
+}
+
+// bodyAllowed returns true if a response with the status can have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+// hasToken returns true if the comma separated values have the token.
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// InputLimitError is the error of the Closed event of a connection whose
+// unconsumed input reached the MaxInputBuffer limit.
+type InputLimitError struct {
+	Limit int // the MaxInputBuffer limit
+}
+
+func (e *InputLimitError) Error() string {
+	return "input buffer limit of " + strconv.Itoa(e.Limit) + " bytes exceeded"
+}
+
+// inputReadSize is the least space that is made for a read.
+const inputReadSize = 4096
+
+// InputBuffer is the input of a connection that is kept until it's
+// consumed. The loop reads into the buffer, and the Data event receives all
+// of the unconsumed input, of which the consumed bytes are discarded. The
+// slices that are returned by the buffer are only valid until the next
+// read of the connection.
+type InputBuffer struct {
+	b   []byte // the unconsumed input is b[r:]
+	r   int
+	max int
+}
+
+// Len returns the number of unconsumed bytes.
+func (ib *InputBuffer) Len() int { return len(ib.b) - ib.r }
+
+// Bytes returns the unconsumed bytes.
+func (ib *InputBuffer) Bytes() []byte { return ib.b[ib.r:] }
+
+// Peek returns the next n bytes without consuming them, or nil if fewer
+// bytes are buffered.
+func (ib *InputBuffer) Peek(n int) []byte {
+	if n < 0 || n > ib.Len() {
+		return nil
+	}
+	return ib.b[ib.r : ib.r+n]
+}
+
+// Discard consumes the next n bytes and returns the number of bytes that
+// were discarded, which is less than n if fewer bytes are buffered.
+func (ib *InputBuffer) Discard(n int) int {
+	if n > ib.Len() {
+		n = ib.Len()
+	}
+	if n <= 0 {
+		return 0
+	}
+	ib.r += n
+	if ib.r == len(ib.b) {
+		if cap(ib.b) > 0xFFFF {
+			ib.b = nil
+		} else {
+			ib.b = ib.b[:0]
+		}
+		ib.r = 0
+	}
+	return n
+}
+
+// ReadN consumes and returns the next n bytes, or returns nil and consumes
+// nothing if fewer bytes are buffered.
+func (ib *InputBuffer) ReadN(n int) []byte {
+	p := ib.Peek(n)
+	if p != nil {
+		ib.Discard(n)
+	}
+	return p
+}
+
+// IndexByte returns the index of the first c in the unconsumed bytes, or -1.
+func (ib *InputBuffer) IndexByte(c byte) int {
+	return bytes.IndexByte(ib.Bytes(), c)
+}
+
+// Index returns the index of the first sep in the unconsumed bytes, or -1.
+func (ib *InputBuffer) Index(sep []byte) int {
+	return bytes.Index(ib.Bytes(), sep)
+}
+
+// space returns the free space at the end of the buffer, which the loop
+// reads into, or nil when the buffer is full. Unconsumed bytes are moved to
+// the front, or the buffer grows, when the free space is small.
+func (ib *InputBuffer) space() []byte {
+	free := ib.max - ib.Len()
+	if free <= 0 {
+		return nil
+	}
+	want := inputReadSize
+	if want > free {
+		want = free
+	}
+	if cap(ib.b)-len(ib.b) < want {
+		if ib.r > 0 && cap(ib.b)-ib.Len() >= want {
+			n := copy(ib.b, ib.b[ib.r:])
+			ib.b, ib.r = ib.b[:n], 0
+		} else {
+			size := cap(ib.b) * 2
+			if size < ib.Len()+want {
+				size = ib.Len() + want
+			}
+			if size > ib.max {
+				size = ib.max
+			}
+			b := make([]byte, ib.Len(), size)
+			copy(b, ib.Bytes())
+			ib.b, ib.r = b, 0
+		}
+	}
+	p := ib.b[len(ib.b):cap(ib.b)]
+	if len(p) > free {
+		p = p[:free]
+	}
+	return p
+}
+
+// commit adds the n bytes that were read into the space.
+func (ib *InputBuffer) commit(n int) { ib.b = ib.b[:len(ib.b)+n] }
+
+// write adds input that was read elsewhere, such as TLS plaintext. It
+// returns false if the input doesn't fit.
+func (ib *InputBuffer) write(p []byte) bool {
+	for len(p) > 0 {
+		space := ib.space()
+		if space == nil {
+			return false
+		}
+		n := copy(space, p)
+		ib.commit(n)
+		p = p[n:]
+	}
+	return true
+}
+
+// newInputBuffer returns the input buffer of a connection with the events,
+// or nil if the events have no MaxInputBuffer.
+func newInputBuffer(events *Events) *InputBuffer {
+	if events.MaxInputBuffer <= 0 {
+		return nil
+	}
+	return &InputBuffer{max: events.MaxInputBuffer}
+}
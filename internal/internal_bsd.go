@@ -123,3 +123,9 @@ func (p *Poll) ModDetach(fd int) {
 		},
 	)
 }
+
+// setsockoptIPv4Multicast sets an IPv4 multicast option, which is a byte on
+// the BSDs.
+func setsockoptIPv4Multicast(fd, opt, v int) error {
+	return syscall.SetsockoptByte(fd, syscall.IPPROTO_IP, opt, byte(v))
+}
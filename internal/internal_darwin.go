@@ -18,3 +18,24 @@ func SetKeepAlive(fd, secs int) error {
 	}
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPALIVE, secs)
 }
+
+// Accept accepts a connection on the listening socket fd. The returned
+// file descriptor is non-blocking and close-on-exec.
+func Accept(fd int) (nfd int, sa syscall.Sockaddr, err error) {
+	// Darwin has no accept4, so hold the fork lock to avoid leaking the
+	// descriptor into a child process before close-on-exec is set.
+	syscall.ForkLock.RLock()
+	nfd, sa, err = syscall.Accept(fd)
+	if err == nil {
+		syscall.CloseOnExec(nfd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return -1, nil, err
+	}
+	if err := syscall.SetNonblock(nfd, true); err != nil {
+		syscall.Close(nfd)
+		return -1, nil, err
+	}
+	return nfd, sa, nil
+}
@@ -130,3 +130,9 @@ func (p *Poll) ModDetach(fd int) {
 		panic(err)
 	}
 }
+
+// setsockoptIPv4Multicast sets an IPv4 multicast option, which is an int on
+// Linux.
+func setsockoptIPv4Multicast(fd, opt, v int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, opt, v)
+}
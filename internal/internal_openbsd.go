@@ -4,8 +4,16 @@
 
 package internal
 
+import "syscall"
+
 // SetKeepAlive sets the keepalive for the connection
 func SetKeepAlive(fd, secs int) error {
 	// OpenBSD has no user-settable per-socket TCP keepalive options.
 	return nil
 }
+
+// Accept accepts a connection on the listening socket fd. The returned
+// file descriptor is non-blocking and close-on-exec.
+func Accept(fd int) (nfd int, sa syscall.Sockaddr, err error) {
+	return syscall.Accept4(fd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+}
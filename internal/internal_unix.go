@@ -17,3 +17,9 @@ func SetKeepAlive(fd, secs int) error {
 	}
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs)
 }
+
+// Accept accepts a connection on the listening socket fd. The returned
+// file descriptor is non-blocking and close-on-exec.
+func Accept(fd int) (nfd int, sa syscall.Sockaddr, err error) {
+	return syscall.Accept4(fd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+}
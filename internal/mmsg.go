@@ -0,0 +1,116 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package internal
+
+import (
+	"net"
+	"syscall"
+)
+
+// Message is a datagram that is read by RecvMsgs or written by SendMsgs.
+type Message struct {
+	Buf  []byte           // datagram buffer
+	N    int              // number of bytes read into Buf
+	OOB  []byte           // control message buffer
+	OOBN int              // number of bytes read into OOB
+	Addr syscall.Sockaddr // remote address
+}
+
+// UDPControl is the control message data of a received datagram.
+type UDPControl struct {
+	Segment int    // size of the coalesced datagrams, or zero
+	Dst     net.IP // local destination address, 4 bytes for IP_PKTINFO
+	Src     net.IP // local address for replies, which is never broadcast
+	Ifindex int    // interface index of the destination address
+}
+
+// SendTo writes a datagram with the control message, if any.
+func SendTo(fd int, b, oob []byte, sa syscall.Sockaddr) error {
+	if len(oob) == 0 {
+		return syscall.Sendto(fd, b, 0, sa)
+	}
+	_, err := syscall.SendmsgN(fd, b, oob, sa, 0)
+	return err
+}
+
+// Batch reads and writes multiple datagrams with a single syscall, using
+// recvmmsg and sendmmsg where available. A Batch holds the syscall buffers
+// and is not safe for concurrent use.
+type Batch struct {
+	sys batchSys
+}
+
+// recvLoop reads datagrams one at a time until msgs is full or there are
+// no more datagrams to read.
+func recvLoop(fd int, msgs []Message) (int, error) {
+	var n int
+	for ; n < len(msgs); n++ {
+		nn, oobn, _, sa, err := syscall.Recvmsg(fd, msgs[n].Buf, msgs[n].OOB, 0)
+		if err != nil {
+			if n > 0 && err == syscall.EAGAIN {
+				break
+			}
+			return n, err
+		}
+		msgs[n].N = nn
+		msgs[n].OOBN = oobn
+		msgs[n].Addr = sa
+	}
+	return n, nil
+}
+
+// maxSegments is the maximum number of segments that are written with a
+// single syscall by SendSegments.
+const maxSegments = 64
+
+// segmentChunk returns the number of bytes of b to write with a single
+// syscall when b is split into datagrams of size bytes.
+func segmentChunk(b []byte, size int) int {
+	n := maxSegments
+	if max := 0xFFFF / size; max < n {
+		n = max
+	}
+	if n*size > len(b) {
+		return len(b)
+	}
+	return n * size
+}
+
+// sendSegmentsLoop writes b as datagrams of size bytes, one at a time.
+func sendSegmentsLoop(fd int, b []byte, size int, sa syscall.Sockaddr,
+	oob []byte) error {
+	for len(b) > 0 {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		if err := SendTo(fd, b[:n], oob, sa); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// sendLoop writes the datagrams one at a time. A datagram that fails, such
+// as for an unreachable address, doesn't hold back the rest. Returns the
+// number of datagrams that were written and the first error.
+func sendLoop(fd int, msgs []Message) (int, error) {
+	var n int
+	var ferr error
+	for i := range msgs {
+		err := SendTo(fd, msgs[i].Buf, msgs[i].OOB, msgs[i].Addr)
+		if err != nil {
+			if ferr == nil {
+				ferr = err
+			}
+			continue
+		}
+		n++
+	}
+	return n, ferr
+}
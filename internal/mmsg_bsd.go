@@ -0,0 +1,56 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+type batchSys struct{}
+
+// RecvMsgs reads up to len(msgs) datagrams. Returns the number of datagrams
+// that were read.
+func (b *Batch) RecvMsgs(fd int, msgs []Message) (int, error) {
+	return recvLoop(fd, msgs)
+}
+
+// SendMsgs writes the datagrams. Returns the number of datagrams that were
+// written.
+func (b *Batch) SendMsgs(fd int, msgs []Message) (int, error) {
+	return sendLoop(fd, msgs)
+}
+
+// SetUDPGRO enables receiving coalesced datagrams. It's only available on
+// Linux and does nothing on this platform.
+func SetUDPGRO(fd int) error {
+	return nil
+}
+
+// SetPktinfo enables receiving the local destination addresses of
+// datagrams. It's only available on Linux.
+func SetPktinfo(fd int, ipv6 bool) error {
+	return errors.New("pktinfo is not available")
+}
+
+// ParseUDPControl parses the control message of a received datagram.
+func ParseUDPControl(oob []byte) UDPControl {
+	return UDPControl{}
+}
+
+// PktinfoOOB returns the control message for writing a datagram from the
+// local address of a received datagram.
+func PktinfoOOB(ctl UDPControl) []byte {
+	return nil
+}
+
+// SendSegments writes b as datagrams of size bytes, where the last datagram
+// may be smaller.
+func SendSegments(fd int, b []byte, size int, sa syscall.Sockaddr,
+	oob []byte) error {
+	return sendSegmentsLoop(fd, b, size, sa, oob)
+}
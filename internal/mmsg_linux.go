@@ -0,0 +1,293 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	solUDP     = 17  // SOL_UDP
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+)
+
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+type batchSys struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+// prepare fills the message headers for the datagrams.
+func (b *batchSys) prepare(msgs []Message) {
+	if len(b.hdrs) < len(msgs) {
+		b.hdrs = make([]mmsghdr, len(msgs))
+		b.iovs = make([]syscall.Iovec, len(msgs))
+		b.names = make([]syscall.RawSockaddrAny, len(msgs))
+	}
+	for i := range msgs {
+		b.iovs[i].Base = nil
+		if len(msgs[i].Buf) > 0 {
+			b.iovs[i].Base = &msgs[i].Buf[0]
+		}
+		b.iovs[i].SetLen(len(msgs[i].Buf))
+		h := &b.hdrs[i].hdr
+		*h = syscall.Msghdr{}
+		h.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		h.Namelen = syscall.SizeofSockaddrAny
+		h.Iov = &b.iovs[i]
+		h.Iovlen = 1
+		if len(msgs[i].OOB) > 0 {
+			h.Control = &msgs[i].OOB[0]
+			h.SetControllen(len(msgs[i].OOB))
+		}
+		b.hdrs[i].len = 0
+	}
+}
+
+// RecvMsgs reads up to len(msgs) datagrams. Returns the number of datagrams
+// that were read.
+func (b *Batch) RecvMsgs(fd int, msgs []Message) (int, error) {
+	if sysRECVMMSG == 0 || len(msgs) == 0 {
+		return recvLoop(fd, msgs)
+	}
+	b.sys.prepare(msgs)
+	for {
+		r0, _, e0 := syscall.Syscall6(sysRECVMMSG, uintptr(fd),
+			uintptr(unsafe.Pointer(&b.sys.hdrs[0])), uintptr(len(msgs)),
+			0, 0, 0)
+		if e0 != 0 {
+			if e0 == syscall.EINTR {
+				continue
+			}
+			return 0, e0
+		}
+		n := int(r0)
+		for i := 0; i < n; i++ {
+			msgs[i].N = int(b.sys.hdrs[i].len)
+			msgs[i].OOBN = int(b.sys.hdrs[i].hdr.Controllen)
+			msgs[i].Addr = anyToSockaddr(&b.sys.names[i],
+				b.sys.hdrs[i].hdr.Namelen)
+		}
+		return n, nil
+	}
+}
+
+// SendMsgs writes the datagrams. Returns the number of datagrams that were
+// written.
+func (b *Batch) SendMsgs(fd int, msgs []Message) (int, error) {
+	if sysSENDMMSG == 0 || len(msgs) == 0 {
+		return sendLoop(fd, msgs)
+	}
+	b.sys.prepare(msgs)
+	for i := range msgs {
+		h := &b.sys.hdrs[i].hdr
+		h.Namelen = sockaddrToAny(msgs[i].Addr, &b.sys.names[i])
+	}
+	var sent int
+	for sent < len(msgs) {
+		r0, _, e0 := syscall.Syscall6(sysSENDMMSG, uintptr(fd),
+			uintptr(unsafe.Pointer(&b.sys.hdrs[sent])),
+			uintptr(len(msgs)-sent), 0, 0, 0)
+		if e0 != 0 {
+			if e0 == syscall.EINTR {
+				continue
+			}
+			// sendmmsg stops at the first datagram that fails, so the
+			// rest are written one at a time
+			n, err := sendLoop(fd, msgs[sent:])
+			return sent + n, err
+		}
+		sent += int(r0)
+	}
+	return sent, nil
+}
+
+// anyToSockaddr converts a raw IPv4, IPv6, or unix address of namelen bytes.
+func anyToSockaddr(rsa *syscall.RawSockaddrAny,
+	namelen uint32) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_UNIX:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		n := int(namelen) - 2 // the length of the path
+		if n <= 0 {
+			return &syscall.SockaddrUnix{} // unnamed
+		}
+		path := (*[len(pp.Path)]byte)(unsafe.Pointer(&pp.Path))[:n]
+		if path[0] == 0 {
+			// abstract, which is not terminated
+			return &syscall.SockaddrUnix{Name: "@" + string(path[1:])}
+		}
+		for i, c := range path {
+			if c == 0 {
+				path = path[:i]
+				break
+			}
+		}
+		return &syscall.SockaddrUnix{Name: string(path)}
+	case syscall.AF_INET:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet4{Addr: pp.Addr}
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		sa.Port = int(p[0])<<8 + int(p[1])
+		return sa
+	case syscall.AF_INET6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet6{Addr: pp.Addr, ZoneId: pp.Scope_id}
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		sa.Port = int(p[0])<<8 + int(p[1])
+		return sa
+	}
+	return nil
+}
+
+// sockaddrToAny converts an IPv4, IPv6, or unix address to its raw form and
+// returns its length.
+func sockaddrToAny(sa syscall.Sockaddr, rsa *syscall.RawSockaddrAny) uint32 {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrUnix:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		*pp = syscall.RawSockaddrUnix{Family: syscall.AF_UNIX}
+		path := (*[len(pp.Path)]byte)(unsafe.Pointer(&pp.Path))
+		n := copy(path[:len(path)-1], sa.Name)
+		if n > 0 && path[0] == '@' {
+			// abstract, which is not terminated
+			path[0] = 0
+			return uint32(2 + n)
+		}
+		return uint32(2 + n + 1)
+	case *syscall.SockaddrInet4:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		*pp = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: sa.Addr}
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		p[0], p[1] = byte(sa.Port>>8), byte(sa.Port)
+		return syscall.SizeofSockaddrInet4
+	case *syscall.SockaddrInet6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		*pp = syscall.RawSockaddrInet6{Family: syscall.AF_INET6,
+			Addr: sa.Addr, Scope_id: sa.ZoneId}
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		p[0], p[1] = byte(sa.Port>>8), byte(sa.Port)
+		return syscall.SizeofSockaddrInet6
+	}
+	return 0
+}
+
+// SetUDPGRO enables receiving coalesced datagrams. The segment size of a
+// received datagram is returned by ParseUDPControl.
+func SetUDPGRO(fd int) error {
+	return syscall.SetsockoptInt(fd, solUDP, udpGRO, 1)
+}
+
+// SetPktinfo enables receiving the local destination addresses of
+// datagrams. IPv6 sockets also receive them for IPv4 datagrams.
+func SetPktinfo(fd int, ipv6 bool) error {
+	if ipv6 {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6,
+			syscall.IPV6_RECVPKTINFO, 1); err != nil {
+			return err
+		}
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		return nil
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+}
+
+// ParseUDPControl parses the control message of a received datagram.
+func ParseUDPControl(oob []byte) UDPControl {
+	var ctl UDPControl
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return ctl
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == solUDP && m.Header.Type == udpGRO &&
+			len(m.Data) >= 4:
+			ctl.Segment = int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		case m.Header.Level == syscall.IPPROTO_IP &&
+			m.Header.Type == syscall.IP_PKTINFO &&
+			len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			pi := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			ctl.Dst = append(net.IP{}, pi.Addr[:]...)
+			// the specific destination is the local address of the
+			// interface, also for datagrams to a broadcast address
+			ctl.Src = append(net.IP{}, pi.Spec_dst[:]...)
+			ctl.Ifindex = int(pi.Ifindex)
+		case m.Header.Level == syscall.IPPROTO_IPV6 &&
+			m.Header.Type == syscall.IPV6_PKTINFO &&
+			len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			pi := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			ctl.Dst = append(net.IP{}, pi.Addr[:]...)
+			ctl.Src = ctl.Dst
+			ctl.Ifindex = int(pi.Ifindex)
+		}
+	}
+	return ctl
+}
+
+// PktinfoOOB returns the control message for writing a datagram from the
+// local reply address of a received datagram.
+func PktinfoOOB(ctl UDPControl) []byte {
+	switch len(ctl.Src) {
+	case 4:
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = syscall.IPPROTO_IP
+		h.Type = syscall.IP_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		pi := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		copy(pi.Spec_dst[:], ctl.Src)
+		pi.Ifindex = int32(ctl.Ifindex)
+		return oob
+	case 16:
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+		h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		h.Level = syscall.IPPROTO_IPV6
+		h.Type = syscall.IPV6_PKTINFO
+		h.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+		pi := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		copy(pi.Addr[:], ctl.Src)
+		pi.Ifindex = uint32(ctl.Ifindex)
+		return oob
+	}
+	return nil
+}
+
+// SendSegments writes b as datagrams of size bytes, where the last datagram
+// may be smaller. The datagrams are written with UDP_SEGMENT, and one at a
+// time when the kernel does not support it.
+func SendSegments(fd int, b []byte, size int, sa syscall.Sockaddr,
+	oob []byte) error {
+	if size <= 0 || len(b) <= size {
+		return SendTo(fd, b, oob, sa)
+	}
+	seg := make([]byte, syscall.CmsgSpace(2), syscall.CmsgSpace(2)+len(oob))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&seg[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&seg[syscall.CmsgLen(0)])) = uint16(size)
+	seg = append(seg, oob...)
+	for len(b) > 0 {
+		n := segmentChunk(b, size)
+		if _, err := syscall.SendmsgN(fd, b[:n], seg, sa, 0); err != nil {
+			if err == syscall.EAGAIN {
+				return err
+			}
+			// segmentation offload is not supported
+			return sendSegmentsLoop(fd, b, size, sa, oob)
+		}
+		b = b[n:]
+	}
+	return nil
+}
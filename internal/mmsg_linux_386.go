@@ -0,0 +1,10 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+const (
+	sysRECVMMSG = 337
+	sysSENDMMSG = 345
+)
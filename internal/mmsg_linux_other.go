@@ -0,0 +1,14 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux,!amd64,!arm64,!386,!arm
+
+package internal
+
+// recvmmsg and sendmmsg are not used on this architecture, and datagrams are
+// read and written one at a time.
+const (
+	sysRECVMMSG = 0
+	sysSENDMMSG = 0
+)
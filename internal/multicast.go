@@ -0,0 +1,84 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package internal
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// JoinGroup joins or leaves the multicast group on the interface. A nil
+// interface lets the system choose one.
+func JoinGroup(fd int, group net.IP, ifi *net.Interface, join bool) error {
+	if ip4 := group.To4(); ip4 != nil {
+		mreq := &syscall.IPMreq{}
+		copy(mreq.Multiaddr[:], ip4)
+		if ifi != nil {
+			ifaddr, err := interfaceIPv4(ifi)
+			if err != nil {
+				return err
+			}
+			copy(mreq.Interface[:], ifaddr)
+		}
+		opt := syscall.IP_ADD_MEMBERSHIP
+		if !join {
+			opt = syscall.IP_DROP_MEMBERSHIP
+		}
+		return syscall.SetsockoptIPMreq(fd, syscall.IPPROTO_IP, opt, mreq)
+	}
+	mreq := &syscall.IPv6Mreq{}
+	copy(mreq.Multiaddr[:], group.To16())
+	if ifi != nil {
+		mreq.Interface = uint32(ifi.Index)
+	}
+	opt := syscall.IPV6_JOIN_GROUP
+	if !join {
+		opt = syscall.IPV6_LEAVE_GROUP
+	}
+	return syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, opt, mreq)
+}
+
+// SetMulticastLoop enables or disables receiving the multicast datagrams
+// that are sent from the host.
+func SetMulticastLoop(fd int, ipv6, on bool) error {
+	var v int
+	if on {
+		v = 1
+	}
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6,
+			syscall.IPV6_MULTICAST_LOOP, v)
+	}
+	return setsockoptIPv4Multicast(fd, syscall.IP_MULTICAST_LOOP, v)
+}
+
+// SetMulticastTTL sets the time-to-live, or hop limit, of the multicast
+// datagrams that are sent from the socket.
+func SetMulticastTTL(fd int, ipv6 bool, ttl int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6,
+			syscall.IPV6_MULTICAST_HOPS, ttl)
+	}
+	return setsockoptIPv4Multicast(fd, syscall.IP_MULTICAST_TTL, ttl)
+}
+
+// interfaceIPv4 returns the first IPv4 address of the interface.
+func interfaceIPv4(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				return ip4, nil
+			}
+		}
+	}
+	return nil, errors.New("no IPv4 address for interface " + ifi.Name)
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin freebsd dragonfly
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	solLocal      = 0 // SOL_LOCAL
+	localPeercred = 1 // LOCAL_PEERCRED
+)
+
+// xucred is the credentials that are returned by LOCAL_PEERCRED.
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+	_       [8]byte // FreeBSD process id
+}
+
+// PeerCredentials returns the credentials of the process that connected to
+// a unix socket. The process id is not available and is -1.
+func PeerCredentials(fd int) (pid, uid, gid int, err error) {
+	var cred xucred
+	n := uint32(unsafe.Sizeof(cred))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		solLocal, localPeercred, uintptr(unsafe.Pointer(&cred)),
+		uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, 0, 0, errno
+	}
+	if cred.ngroups < 1 {
+		return 0, 0, 0, syscall.EINVAL
+	}
+	return -1, int(cred.uid), int(cred.groups[0]), nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import "syscall"
+
+// PeerCredentials returns the credentials of the process that connected to
+// a unix socket.
+func PeerCredentials(fd int) (pid, uid, gid int, err error) {
+	cred, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	solLocal     = 0 // SOL_LOCAL
+	localPeereid = 3 // LOCAL_PEEREID
+)
+
+// unpcbid is the credentials that are returned by LOCAL_PEEREID.
+type unpcbid struct {
+	pid int32
+	uid uint32
+	gid uint32
+}
+
+// PeerCredentials returns the credentials of the process that connected to
+// a unix socket.
+func PeerCredentials(fd int) (pid, uid, gid int, err error) {
+	var cred unpcbid
+	n := uint32(unsafe.Sizeof(cred))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		solLocal, localPeereid, uintptr(unsafe.Pointer(&cred)),
+		uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, 0, 0, errno
+	}
+	return int(cred.pid), int(cred.uid), int(cred.gid), nil
+}
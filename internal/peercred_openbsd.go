@@ -0,0 +1,31 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// sockpeercred is the credentials that are returned by SO_PEERCRED.
+type sockpeercred struct {
+	uid uint32
+	gid uint32
+	pid int32
+}
+
+// PeerCredentials returns the credentials of the process that connected to
+// a unix socket.
+func PeerCredentials(fd int) (pid, uid, gid int, err error) {
+	var cred sockpeercred
+	n := uint32(unsafe.Sizeof(cred))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		syscall.SOL_SOCKET, syscall.SO_PEERCRED,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, 0, 0, errno
+	}
+	return int(cred.pid), int(cred.uid), int(cred.gid), nil
+}
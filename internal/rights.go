@@ -0,0 +1,62 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package internal
+
+import "syscall"
+
+// MaxRights is the maximum number of file descriptors that are passed with
+// a single message.
+const MaxRights = 253
+
+// ReadRights reads from a unix socket like syscall.Read, and returns the
+// file descriptors that are passed along with the data. The oob buffer
+// should fit MaxRights descriptors.
+func ReadRights(fd int, p, oob []byte) (n int, fds []int, err error) {
+	// hold the fork lock to avoid leaking the descriptors into a child
+	// process before close-on-exec is set.
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	n, oobn, _, _, err := syscall.Recvmsg(fd, p, oob, 0)
+	if err != nil || oobn == 0 {
+		return n, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, nil, nil
+	}
+	for i := range msgs {
+		if msgs[i].Header.Level == syscall.SOL_SOCKET &&
+			msgs[i].Header.Type == syscall.SCM_RIGHTS {
+			rights, err := syscall.ParseUnixRights(&msgs[i])
+			if err == nil {
+				fds = append(fds, rights...)
+			}
+		}
+	}
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+	}
+	return n, fds, nil
+}
+
+// WriteRights writes to a unix socket like syscall.Write, and passes the
+// file descriptors along with the data.
+func WriteRights(fd int, p []byte, fds []int) (n int, err error) {
+	return syscall.SendmsgN(fd, p, syscall.UnixRights(fds...), nil, 0)
+}
+
+// Dup duplicates a file descriptor with close-on-exec set.
+func Dup(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(nfd)
+	return nfd, nil
+}
@@ -11,29 +11,39 @@ import (
 
 // SockaddrToAddr returns a go/net friendly address
 func SockaddrToAddr(sa syscall.Sockaddr) net.Addr {
-	var a net.Addr
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4, *syscall.SockaddrInet6:
+		ip, port, zone := sockaddrInet(sa)
+		return &net.TCPAddr{IP: ip, Port: port, Zone: zone}
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Net: "unix", Name: sa.Name}
+	}
+	return nil
+}
+
+// SockaddrToUDPAddr returns a go/net friendly address for a datagram.
+func SockaddrToUDPAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4, *syscall.SockaddrInet6:
+		ip, port, zone := sockaddrInet(sa)
+		return &net.UDPAddr{IP: ip, Port: port, Zone: zone}
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Net: "unixgram", Name: sa.Name}
+	}
+	return nil
+}
+
+func sockaddrInet(sa syscall.Sockaddr) (ip net.IP, port int, zone string) {
 	switch sa := sa.(type) {
 	case *syscall.SockaddrInet4:
-		a = &net.TCPAddr{
-			IP:   append([]byte{}, sa.Addr[:]...),
-			Port: sa.Port,
-		}
+		return append(net.IP{}, sa.Addr[:]...), sa.Port, ""
 	case *syscall.SockaddrInet6:
-		var zone string
 		if sa.ZoneId != 0 {
 			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
 				zone = ifi.Name
 			}
 		}
-		if zone == "" && sa.ZoneId != 0 {
-		}
-		a = &net.TCPAddr{
-			IP:   append([]byte{}, sa.Addr[:]...),
-			Port: sa.Port,
-			Zone: zone,
-		}
-	case *syscall.SockaddrUnix:
-		a = &net.UnixAddr{Net: "unix", Name: sa.Name}
+		return append(net.IP{}, sa.Addr[:]...), sa.Port, zone
 	}
-	return a
+	return nil, 0, ""
 }
@@ -0,0 +1,194 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyHeader is the PROXY protocol header that a load balancer sends at the
+// start of a connection. The connection's RemoteAddr and LocalAddr are
+// replaced by the Source and Destination addresses of the header.
+type ProxyHeader struct {
+	Version     int      // 1 for the text header, 2 for the binary header
+	Local       bool     // LOCAL command, such as for health checks
+	Source      net.Addr // original client address, or nil if unknown
+	Destination net.Addr // original server address, or nil if unknown
+	TLVs        []ProxyTLV
+}
+
+// ProxyTLV is a type-length-value field of a version 2 PROXY header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+var errProxyShort = errors.New("incomplete proxy header")
+var errProxyHeader = errors.New("malformed proxy header")
+
+var proxyV1Sig = []byte("PROXY ")
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1Max is the maximum length of a version 1 header.
+const proxyV1Max = 107
+
+// parseProxyHeader parses the PROXY protocol header at the start of b and
+// returns the number of bytes that it used. It returns errProxyShort when
+// more data is needed.
+func parseProxyHeader(b []byte) (hdr *ProxyHeader, n int, err error) {
+	switch {
+	case hasSigPrefix(b, proxyV1Sig):
+		return parseProxyV1(b)
+	case hasSigPrefix(b, proxyV2Sig):
+		return parseProxyV2(b)
+	}
+	return nil, 0, errProxyHeader
+}
+
+// hasSigPrefix returns true if b starts with sig, or if b is shorter than
+// sig and could be the start of it.
+func hasSigPrefix(b, sig []byte) bool {
+	if len(b) < len(sig) {
+		return bytes.HasPrefix(sig, b)
+	}
+	return bytes.HasPrefix(b, sig)
+}
+
+func parseProxyV1(b []byte) (*ProxyHeader, int, error) {
+	end := bytes.Index(b, []byte("\r\n"))
+	if end == -1 {
+		if len(b) >= proxyV1Max {
+			return nil, 0, errProxyHeader
+		}
+		return nil, 0, errProxyShort
+	}
+	if end+2 > proxyV1Max {
+		return nil, 0, errProxyHeader
+	}
+	hdr := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(b[len(proxyV1Sig):end]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return hdr, end + 2, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, 0, errProxyHeader
+	}
+	if len(fields) != 5 {
+		return nil, 0, errProxyHeader
+	}
+	src, dst := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	sport, serr := parseProxyPort(fields[3])
+	dport, derr := parseProxyPort(fields[4])
+	if src == nil || dst == nil || serr != nil || derr != nil ||
+		(src.To4() != nil) != (fields[0] == "TCP4") ||
+		(dst.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, 0, errProxyHeader
+	}
+	hdr.Source = &net.TCPAddr{IP: src, Port: sport}
+	hdr.Destination = &net.TCPAddr{IP: dst, Port: dport}
+	return hdr, end + 2, nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	if len(s) == 0 || (len(s) > 1 && s[0] == '0') {
+		return 0, errProxyHeader
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	return int(port), err
+}
+
+func parseProxyV2(b []byte) (*ProxyHeader, int, error) {
+	if len(b) < 16 {
+		return nil, 0, errProxyShort
+	}
+	n := 16 + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return nil, 0, errProxyShort
+	}
+	if b[12]>>4 != 2 {
+		return nil, 0, errProxyHeader
+	}
+	hdr := &ProxyHeader{Version: 2}
+	switch b[12] & 0xF {
+	case 0:
+		hdr.Local = true
+	case 1:
+	default:
+		return nil, 0, errProxyHeader
+	}
+	body := b[16:n]
+	var size int
+	switch b[13] >> 4 {
+	case 0: // unspecified
+	case 1: // inet
+		size = 12
+		if len(body) >= size {
+			hdr.Source = &net.TCPAddr{
+				IP:   append(net.IP{}, body[0:4]...),
+				Port: int(binary.BigEndian.Uint16(body[8:10])),
+			}
+			hdr.Destination = &net.TCPAddr{
+				IP:   append(net.IP{}, body[4:8]...),
+				Port: int(binary.BigEndian.Uint16(body[10:12])),
+			}
+		}
+	case 2: // inet6
+		size = 36
+		if len(body) >= size {
+			hdr.Source = &net.TCPAddr{
+				IP:   append(net.IP{}, body[0:16]...),
+				Port: int(binary.BigEndian.Uint16(body[32:34])),
+			}
+			hdr.Destination = &net.TCPAddr{
+				IP:   append(net.IP{}, body[16:32]...),
+				Port: int(binary.BigEndian.Uint16(body[34:36])),
+			}
+		}
+	case 3: // unix
+		size = 216
+		if len(body) >= size {
+			hdr.Source = &net.UnixAddr{Net: "unix", Name: cstring(body[0:108])}
+			hdr.Destination = &net.UnixAddr{Net: "unix", Name: cstring(body[108:216])}
+		}
+	default:
+		return nil, 0, errProxyHeader
+	}
+	if len(body) < size {
+		return nil, 0, errProxyHeader
+	}
+	for tlvs := body[size:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, errProxyHeader
+		}
+		vlen := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+vlen {
+			return nil, 0, errProxyHeader
+		}
+		hdr.TLVs = append(hdr.TLVs, ProxyTLV{
+			Type:  tlvs[0],
+			Value: append([]byte{}, tlvs[3:3+vlen]...),
+		})
+		tlvs = tlvs[3+vlen:]
+	}
+	if hdr.Local {
+		// the addresses of a LOCAL header are ignored
+		hdr.Source, hdr.Destination = nil, nil
+	}
+	return hdr, n, nil
+}
+
+// cstring returns the string up to the first zero byte.
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,261 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"io"
+	"time"
+)
+
+// Match is the result of a Matcher.
+type Match int
+
+const (
+	// MatchNo means that the connection is not of the protocol.
+	MatchNo Match = iota
+	// MatchYes means that the connection is of the protocol.
+	MatchYes
+	// MatchMore means that more bytes are needed to decide.
+	MatchMore
+)
+
+// Matcher decides if a connection is of a protocol by its first bytes.
+type Matcher func(b []byte) Match
+
+// MatchPrefix matches the connections that start with any of the prefixes.
+func MatchPrefix(prefixes ...string) Matcher {
+	return func(b []byte) Match {
+		match := MatchNo
+		for _, prefix := range prefixes {
+			if len(b) >= len(prefix) {
+				if string(b[:len(prefix)]) == prefix {
+					return MatchYes
+				}
+			} else if prefix[:len(b)] == string(b) {
+				match = MatchMore
+			}
+		}
+		return match
+	}
+}
+
+// MatchHTTP matches the HTTP/1.x requests by their method.
+func MatchHTTP() Matcher {
+	return MatchPrefix("GET ", "HEAD ", "POST ", "PUT ", "DELETE ",
+		"CONNECT ", "OPTIONS ", "TRACE ", "PATCH ")
+}
+
+// MatchTLS matches the connections that start with a TLS ClientHello.
+func MatchTLS() Matcher {
+	return func(b []byte) Match {
+		// handshake record, version 3.x, ClientHello message
+		if (len(b) > 0 && b[0] != 0x16) || (len(b) > 1 && b[1] != 0x03) ||
+			(len(b) > 5 && b[5] != 0x01) {
+			return MatchNo
+		}
+		if len(b) < 6 {
+			return MatchMore
+		}
+		return MatchYes
+	}
+}
+
+// SniffMux serves several protocols on the same address by matching the
+// first bytes of each connection, such as the redis protocol and HTTP on a
+// single port. The first bytes are buffered until a Matcher decides, and
+// then the Opened event of the protocol fires followed by a Data event with
+// the buffered bytes. Protocols where the server speaks first can't be
+// matched.
+type SniffMux struct {
+	// Timeout is how long a connection can take to send enough bytes to
+	// match a protocol. Undecided connections are then handed to the
+	// Fallback. Setting to 0 means no timeout.
+	Timeout time.Duration
+	// MaxBytes is the number of bytes after which an undecided connection
+	// is handed to the Fallback. Setting to 0 means 4096 bytes.
+	MaxBytes int
+	// Fallback are the events of the connections that match no protocol.
+	// Setting to nil closes the connections.
+	Fallback *Events
+
+	matchers []Matcher
+	events   []*Events
+}
+
+// Handle adds a protocol. The matchers are tried in the order that they were
+// added. Only the Opened, Closed, Detached, Data, and Frame events and the
+// Codec are used, and the options that are returned from the Opened event are
+// ignored. When the events of the mux have a MaxInputBuffer, the undecided
+// bytes are kept in the input buffer of the connection, which is also used by
+// the protocols that have a MaxInputBuffer.
+func (m *SniffMux) Handle(match Matcher, events Events) {
+	setFrameData(&events)
+	m.matchers = append(m.matchers, match)
+	m.events = append(m.events, &events)
+}
+
+// sniffConn is the connection that the events of a protocol receive. It has
+// its own context because the mux uses the context of the connection.
+type sniffConn struct {
+	Conn
+	ctx    interface{}
+	frames []byte      // partial frame of the Frame event
+	events *Events     // events of the matched protocol
+	is     InputStream // bytes that were read before a match
+	timer  *time.Timer // wakes the connection once the timeout passes
+	expire time.Time   // time that the connection is undecided
+	late   bool        // the timer fired after the match
+}
+
+func (c *sniffConn) Context() interface{}       { return c.ctx }
+func (c *sniffConn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *sniffConn) frameBuffer() *[]byte       { return &c.frames }
+
+// Input returns the input buffer of the connection if the matched protocol
+// has a MaxInputBuffer.
+func (c *sniffConn) Input() *InputBuffer {
+	if c.events == nil || c.events.MaxInputBuffer <= 0 {
+		return nil
+	}
+	return c.Conn.Input()
+}
+
+// consume discards the buffered input that the Data event of a protocol
+// without a MaxInputBuffer has received.
+func (c *sniffConn) consume() {
+	if ib := c.Conn.Input(); ib != nil && c.Input() == nil {
+		ib.Discard(ib.Len())
+	}
+}
+
+// Events returns the events that serve the protocols. The other events and
+// options, such as Serving and NumLoops, can be set on the returned value.
+func (m *SniffMux) Events() Events {
+	fallback := m.Fallback
+	if fallback != nil {
+		events := *fallback
+		setFrameData(&events)
+		fallback = &events
+	}
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		sc := &sniffConn{Conn: c}
+		c.SetContext(sc)
+		if m.Timeout > 0 {
+			sc.expire = time.Now().Add(m.Timeout)
+			sc.timer = time.AfterFunc(m.Timeout, c.Wake)
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		sc := c.Context().(*sniffConn)
+		if sc.events != nil {
+			if in == nil && sc.late {
+				// the wake of the timer
+				sc.late = false
+				return nil, None
+			}
+			if sc.events.Data == nil {
+				sc.consume()
+				return nil, None
+			}
+			out, action = sc.events.Data(sc, in)
+			sc.consume()
+			return out, action
+		}
+		var data []byte
+		if ib := c.Input(); ib != nil {
+			data = ib.Bytes()
+		} else {
+			data = sc.is.Begin(in)
+		}
+		events, undecided := m.match(data, fallback)
+		if undecided {
+			max := m.MaxBytes
+			if max <= 0 {
+				max = 4096
+			}
+			if len(data) < max &&
+				(sc.timer == nil || time.Now().Before(sc.expire)) {
+				if c.Input() == nil {
+					sc.is.End(data)
+				}
+				return nil, None
+			}
+			events = fallback
+		}
+		if sc.timer != nil && !sc.timer.Stop() {
+			sc.late = in != nil
+		}
+		if events == nil {
+			return nil, Close
+		}
+		sc.events = events
+		sc.is = InputStream{}
+		out, action = m.open(sc, data)
+		sc.consume()
+		return out, action
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		sc, ok := c.Context().(*sniffConn)
+		if !ok {
+			return
+		}
+		if sc.timer != nil {
+			sc.timer.Stop()
+		}
+		if sc.events != nil && sc.events.Closed != nil {
+			return sc.events.Closed(sc, err)
+		}
+		return
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		sc, ok := c.Context().(*sniffConn)
+		if ok && sc.events != nil && sc.events.Detached != nil {
+			return sc.events.Detached(sc, rwc)
+		}
+		rwc.Close()
+		return
+	}
+	return events
+}
+
+// match returns the events of the first protocol that matches the data, or
+// true if a protocol needs more data to decide.
+func (m *SniffMux) match(data []byte, fallback *Events) (events *Events,
+	undecided bool) {
+	for i, match := range m.matchers {
+		switch match(data) {
+		case MatchYes:
+			if !undecided {
+				return m.events[i], false
+			}
+		case MatchMore:
+			undecided = true
+		}
+	}
+	if undecided || len(data) == 0 {
+		return nil, true
+	}
+	return fallback, false
+}
+
+// open fires the Opened event of the matched protocol and then the Data
+// event with the bytes that were buffered.
+func (m *SniffMux) open(sc *sniffConn, data []byte) (out []byte,
+	action Action) {
+	if sc.events.Opened != nil {
+		out, _, action = sc.events.Opened(sc)
+		if action != None {
+			return out, action
+		}
+	}
+	if sc.events.Data != nil && len(data) > 0 {
+		dout, daction := sc.events.Data(sc, data)
+		out = append(out, dout...)
+		action = daction
+	}
+	return out, action
+}
@@ -0,0 +1,335 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errTLSConfig = errors.New("no TLS certificate for the tls address")
+
+// TLSRoute selects the certificate and the connection events of the TLS
+// connections that request a server name or negotiate a protocol.
+type TLSRoute struct {
+	// ServerName is the requested server name, such as "api.example.com"
+	// or "*.example.com". Empty matches any name.
+	ServerName string
+	// Protocol is the ALPN protocol, such as "h2", which is offered to the
+	// clients. Empty matches any protocol. The protocol only selects the
+	// Events, because the certificate is chosen before it's negotiated.
+	Protocol string
+	// Certificate is the certificate for the server name, or nil.
+	Certificate *tls.Certificate
+	// Events are the connection events, or nil. Only the events that follow
+	// the handshake, which are Opened, Closed, Detached, PreWrite, Data, and
+	// Frame, and the Codec are used.
+	Events *Events
+}
+
+// match returns true if the route matches the server name and protocol.
+func (r *TLSRoute) match(name, proto string) bool {
+	if r.Protocol != "" && r.Protocol != proto {
+		return false
+	}
+	if r.ServerName == "" || strings.EqualFold(r.ServerName, name) {
+		return true
+	}
+	if strings.HasPrefix(r.ServerName, "*.") {
+		i := strings.IndexByte(name, '.')
+		return i > 0 && strings.EqualFold(r.ServerName[1:], name[i:])
+	}
+	return false
+}
+
+// tlsConfig returns the TLS configuration of the listener, which is loaded
+// from the cert and key options or otherwise taken from its events, along
+// with the certificates and protocols of the routes.
+func (ln *listener) tlsConfig() *tls.Config {
+	ln.tlsonce.Do(func() {
+		config := ln.tlscfg
+		if config == nil {
+			config = ln.events.TLSConfig
+		}
+		ln.tlsroute = routeTLS(config, ln.events.TLSRoutes)
+		for _, r := range ln.events.TLSRoutes {
+			var events *Events
+			if r.Events != nil {
+				events = new(Events)
+				*events = *r.Events
+				setFrameData(events)
+			}
+			ln.tlsevents = append(ln.tlsevents, events)
+		}
+	})
+	return ln.tlsroute
+}
+
+// routeTLS returns a configuration that chooses the certificate of the
+// routes by the server name and offers the protocols of the routes.
+func routeTLS(config *tls.Config, routes []TLSRoute) *tls.Config {
+	if len(routes) == 0 {
+		return config
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	for _, r := range routes {
+		if r.Protocol != "" && !hasString(config.NextProtos, r.Protocol) {
+			config.NextProtos = append(config.NextProtos, r.Protocol)
+		}
+	}
+	getCertificate := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (
+		*tls.Certificate, error) {
+		for i := range routes {
+			r := &routes[i]
+			if r.Certificate != nil && r.match(hello.ServerName, r.Protocol) {
+				return r.Certificate, nil
+			}
+		}
+		if getCertificate != nil {
+			return getCertificate(hello)
+		}
+		return nil, nil // use the certificates of the config
+	}
+	return config
+}
+
+// tlsEvents returns the events of the first route that matches the TLS
+// connection, or the events of the listener.
+func (ln *listener) tlsEvents(state tls.ConnectionState) *Events {
+	for i := range ln.events.TLSRoutes {
+		r := &ln.events.TLSRoutes[i]
+		if r.Events != nil &&
+			r.match(state.ServerName, state.NegotiatedProtocol) {
+			return ln.tlsevents[i]
+		}
+	}
+	return ln.events
+}
+
+func hasString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTLS returns an error if the listener has the tls option but no TLS
+// configuration. The events are used when the listener has none of its own.
+func checkTLS(ln *listener, events *Events) error {
+	if !ln.opts.tls {
+		return nil
+	}
+	if ln.pconn != nil {
+		return errNotStream
+	}
+	if ln.events != nil {
+		events = ln.events
+	}
+	if ln.tlscfg == nil && events.TLSConfig == nil &&
+		len(events.TLSRoutes) == 0 {
+		return errTLSConfig
+	}
+	return nil
+}
+
+// loadTLS loads the certificate of the cert and key options.
+func loadTLS(ln *listener) error {
+	if !ln.opts.tls || (ln.opts.cert == "" && ln.opts.key == "") {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(ln.opts.cert, ln.opts.key)
+	if err != nil {
+		return err
+	}
+	ln.tlscfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// errWouldBlock is returned by a tlsTransport that has no input after the
+// handshake. It's a temporary error, which crypto/tls does not keep, so the
+// read can be retried once more input arrives.
+var errWouldBlock error = wouldBlockError{}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "tls: would block" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+// tlsTransport is the memory transport under the tls.Conn of a connection on
+// the poll backend. The loop feeds it the ciphertext that is read from the
+// socket and takes the ciphertext that is to be written, so the socket is
+// only used by the loop.
+//
+// A handshake of crypto/tls can't be resumed after a read fails, so it runs
+// on its own goroutine and its reads wait for input. Once the handshake is
+// done the record layer runs on the loop and reads that have no input return
+// errWouldBlock.
+type tlsTransport struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	in     []byte   // ciphertext that was read from the socket
+	out    []byte   // ciphertext to write to the socket
+	block  bool     // reads wait for input during the handshake
+	closed bool     // the connection was closed
+	eof    bool     // the socket has no more input
+	flush  func()   // called for new output during the handshake
+	nc     net.Conn // socket of a detached connection
+	laddr  net.Addr
+	raddr  net.Addr
+}
+
+func newTLSTransport(laddr, raddr net.Addr, in []byte,
+	flush func()) *tlsTransport {
+	t := &tlsTransport{laddr: laddr, raddr: raddr, flush: flush, block: true}
+	t.in = append(t.in, in...)
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// feed adds ciphertext that was read from the socket.
+func (t *tlsTransport) feed(b []byte) {
+	t.mu.Lock()
+	t.in = append(t.in, b...)
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// take returns the ciphertext to write to the socket.
+func (t *tlsTransport) take() []byte {
+	t.mu.Lock()
+	out := t.out
+	t.out = nil
+	t.mu.Unlock()
+	return out
+}
+
+// end tells the transport that the socket has no more input.
+func (t *tlsTransport) end() {
+	t.mu.Lock()
+	t.eof = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// expire closes the transport if the handshake is not yet done, which ends
+// the handshake with an error.
+func (t *tlsTransport) expire() {
+	t.mu.Lock()
+	if t.block {
+		t.closed = true
+		t.cond.Broadcast()
+	}
+	t.mu.Unlock()
+}
+
+// unblock makes reads return errWouldBlock when there's no input.
+func (t *tlsTransport) unblock() {
+	t.mu.Lock()
+	t.block = false
+	t.mu.Unlock()
+}
+
+// detach hands the transport over to the socket of a detached connection.
+// Input that was already fed is read first.
+func (t *tlsTransport) detach(nc net.Conn) {
+	t.mu.Lock()
+	t.nc = nc
+	t.mu.Unlock()
+}
+
+func (t *tlsTransport) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	for len(t.in) == 0 && t.block && !t.closed && !t.eof && t.nc == nil {
+		t.cond.Wait()
+	}
+	if len(t.in) > 0 {
+		n := copy(p, t.in)
+		t.in = t.in[n:]
+		t.mu.Unlock()
+		return n, nil
+	}
+	nc, closed := t.nc, t.closed || t.eof
+	t.mu.Unlock()
+	switch {
+	case nc != nil:
+		return nc.Read(p)
+	case closed:
+		return 0, io.EOF
+	}
+	return 0, errWouldBlock
+}
+
+func (t *tlsTransport) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if nc := t.nc; nc != nil {
+		t.mu.Unlock()
+		return nc.Write(p)
+	}
+	if t.closed {
+		t.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	t.out = append(t.out, p...)
+	block := t.block
+	t.mu.Unlock()
+	if block {
+		t.flush()
+	}
+	return len(p), nil
+}
+
+func (t *tlsTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	nc := t.nc
+	t.mu.Unlock()
+	if nc != nil {
+		return nc.Close()
+	}
+	return nil
+}
+
+func (t *tlsTransport) LocalAddr() net.Addr  { return t.laddr }
+func (t *tlsTransport) RemoteAddr() net.Addr { return t.raddr }
+
+func (t *tlsTransport) SetDeadline(d time.Time) error {
+	if nc := t.detached(); nc != nil {
+		return nc.SetDeadline(d)
+	}
+	return nil
+}
+
+func (t *tlsTransport) SetReadDeadline(d time.Time) error {
+	if nc := t.detached(); nc != nil {
+		return nc.SetReadDeadline(d)
+	}
+	return nil
+}
+
+func (t *tlsTransport) SetWriteDeadline(d time.Time) error {
+	if nc := t.detached(); nc != nil {
+		return nc.SetWriteDeadline(d)
+	}
+	return nil
+}
+
+func (t *tlsTransport) detached() net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nc
+}